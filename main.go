@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/TheZeroSlave/zapsentry"
 	"github.com/alexflint/go-arg"
@@ -44,6 +45,9 @@ type Args struct {
 	SentryDSN   string        `arg:"env:SENTRY_DSN"`
 	SentryLevel zapcore.Level `arg:"env:SENTRY_LEVEL" default:"ERROR"`
 
+	State   *StateCmd   `arg:"subcommand:state" help:"export or import the state of service instances"`
+	Orphans *OrphansCmd `arg:"subcommand:orphans" help:"report differences between the broker state and Atlas"`
+
 	BrokerConfig
 }
 
@@ -63,6 +67,17 @@ type BrokerConfig struct {
 	DocumentationURL    string `arg:"env:BROKER_OSB_DOCS_URL" default:"https://support.mongodb.com/welcome"`
 	ProviderDisplayName string `arg:"env:BROKER_OSB_PROVIDER_DISPLAY_NAME" default:"MongoDB"`
 	LongDescription     string `arg:"env:BROKER_OSB_LONG_DESC" default:"Complete MongoDB Atlas deployments managed through resource templates. See https://github.com/mongodb/atlas-osb"`
+
+	StateStorage    string `arg:"env:BROKER_STATE_STORAGE" default:"realm"`
+	StateStorageURI string `arg:"env:BROKER_STATE_STORAGE_URI"`
+	StateStorageDB  string `arg:"env:BROKER_STATE_STORAGE_DB" default:"atlas-broker"`
+
+	StateIndexRefresh   time.Duration `arg:"env:BROKER_STATE_INDEX_REFRESH" default:"5m"`
+	StateEncryptionKeys string        `arg:"env:BROKER_STATE_ENCRYPTION_KEYS"`
+
+	MaxOperationDuration time.Duration `arg:"env:BROKER_MAX_OPERATION_DURATION" default:"0"`
+	ReconcilerWorkers    int           `arg:"env:BROKER_RECONCILER_WORKERS" default:"4"`
+	ReconcileInterval    time.Duration `arg:"env:BROKER_RECONCILE_INTERVAL" default:"30s"`
 }
 
 // FIXME: update links
@@ -97,7 +112,21 @@ func main() {
 		p.Fail("Both a certificate and private key are necessary to enable TLS")
 	}
 
-	startBrokerServer()
+	var err error
+
+	switch {
+	case args.State != nil:
+		err = runStateCommand(args.State)
+	case args.Orphans != nil:
+		err = runOrphansCommand(args.Orphans)
+	default:
+		startBrokerServer()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func deduceCredentials(logger *zap.SugaredLogger, atlasURL string) *credentials.Credentials {
@@ -143,9 +172,20 @@ func createBroker(logger *zap.SugaredLogger) *broker.Broker {
 	logger.Infow("Creating broker", "atlas_base_url", args.AtlasURL)
 
 	creds := deduceCredentials(logger, args.AtlasURL)
-	userAgent := fmt.Sprintf("%s/%s (%s;%s)", toolName, releaseVersion, runtime.GOOS, runtime.GOARCH)
 
-	return broker.New(logger, creds, broker.Config(args.BrokerConfig), userAgent)
+	return broker.New(logger, creds, broker.Config(args.BrokerConfig), userAgent())
+}
+
+// createCommandBroker creates a broker for subcommands, without the background
+// work of a running broker.
+func createCommandBroker(logger *zap.SugaredLogger) *broker.Broker {
+	creds := deduceCredentials(logger, args.AtlasURL)
+
+	return broker.NewWithoutWorkers(logger, creds, broker.Config(args.BrokerConfig), userAgent())
+}
+
+func userAgent() string {
+	return fmt.Sprintf("%s/%s (%s;%s)", toolName, releaseVersion, runtime.GOOS, runtime.GOARCH)
 }
 
 func startBrokerServer() {
@@ -164,8 +204,10 @@ func startBrokerServer() {
 
 	router := mux.NewRouter()
 	brokerapi.AttachRoutes(router, b, NewLagerZapLogger(logger))
+	router.Handle("/admin/orphans", b.OrphansHandler()).Methods(http.MethodGet, http.MethodPost)
 
 	router.Use(b.AuthMiddleware())
+	router.Use(b.CatalogExtensions())
 
 	tlsEnabled := args.CertPath != ""
 
@@ -0,0 +1,46 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/mongodb/atlas-osb/pkg/broker"
+)
+
+type OrphansCmd struct {
+	CleanInstances bool `help:"remove the state of instances whose project or cluster no longer exists"`
+	CleanProjects  bool `help:"delete projects with broker-managed clusters that no instance refers to"`
+}
+
+func runOrphansCommand(cmd *OrphansCmd) error {
+	logger, err := createLogger()
+	if err != nil {
+		return err
+	}
+
+	b := createCommandBroker(logger)
+	report := b.FindOrphans(context.Background(), broker.OrphanCleanup{
+		Instances: cmd.CleanInstances,
+		Projects:  cmd.CleanProjects,
+	})
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(report)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/pkg/errors"
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+// atlasFailure is how an Atlas API error is reported to the platform.
+type atlasFailure struct {
+	status  int
+	key     string
+	message string
+}
+
+// atlasFailuresByCode maps the error codes of the Atlas API, see
+// https://docs.atlas.mongodb.com/reference/api/api-errors/
+//
+// Resources which already exist in Atlas are reported with 422 rather than
+// 409, which OSB reserves for an instance or binding ID that is already taken.
+var atlasFailuresByCode = map[string]atlasFailure{
+	"DUPLICATE_CLUSTER_NAME": {http.StatusUnprocessableEntity, "ClusterAlreadyExists", "a cluster with this name already exists in the project, which doesn't belong to this instance"},
+	"GROUP_ALREADY_EXISTS":   {http.StatusUnprocessableEntity, "ProjectAlreadyExists", "a project with this name already exists in Atlas, which doesn't belong to this instance"},
+	"USER_ALREADY_EXISTS":    {http.StatusUnprocessableEntity, "UserAlreadyExists", "a database user with this name already exists in the project, but the broker has no binding for it"},
+
+	"INVALID_ATTRIBUTE":   {http.StatusBadRequest, "InvalidParameters", "the parameters are invalid"},
+	"MISSING_ATTRIBUTE":   {http.StatusBadRequest, "InvalidParameters", "a required parameter is missing"},
+	"INVALID_ENUM_VALUE":  {http.StatusBadRequest, "InvalidParameters", "a parameter has an unsupported value"},
+	"ATTRIBUTE_READ_ONLY": {http.StatusBadRequest, "InvalidParameters", "a read-only parameter was set"},
+	"INVALID_JSON":        {http.StatusBadRequest, "InvalidParameters", "the parameters are not valid JSON"},
+
+	"NO_PAYMENT_INFORMATION_FOUND": {http.StatusUnprocessableEntity, "QuotaExceeded", "the Atlas organization has no payment method"},
+}
+
+// atlasFailuresByStatus is used for error codes which aren't listed above.
+var atlasFailuresByStatus = map[int]atlasFailure{
+	http.StatusBadRequest:      {http.StatusBadRequest, "InvalidParameters", "Atlas rejected the request"},
+	http.StatusUnauthorized:    {http.StatusInternalServerError, "AtlasAPIKeyRejected", "Atlas rejected the API key of the broker"},
+	http.StatusForbidden:       {http.StatusInternalServerError, "AtlasAccessDenied", "the API key of the broker is not allowed to do this, check its roles and API access list"},
+	http.StatusConflict:        {http.StatusUnprocessableEntity, "AtlasConflict", "the request conflicts with a resource which already exists in Atlas"},
+	http.StatusTooManyRequests: {http.StatusServiceUnavailable, "AtlasRateLimited", "too many requests to Atlas, try again later"},
+}
+
+// translateAtlasError turns an Atlas API error anywhere in the chain of err
+// into a failure response with a fitting status, error key and description.
+// Other errors are returned as they are.
+func translateAtlasError(err error, action string) error {
+	var resp *mongodbatlas.ErrorResponse
+	if err == nil || !errors.As(err, &resp) {
+		return err
+	}
+
+	f, ok := atlasFailuresByCode[resp.ErrorCode]
+	if !ok {
+		f, ok = atlasFailuresByStatus[resp.HTTPCode]
+	}
+
+	// quota errors don't share a status, but all mention it in the code
+	if !ok && (strings.Contains(resp.ErrorCode, "LIMIT") || strings.Contains(resp.ErrorCode, "EXCEEDED")) {
+		f, ok = atlasFailure{http.StatusUnprocessableEntity, "QuotaExceeded", "an Atlas limit was reached"}, true
+	}
+
+	if !ok {
+		return err
+	}
+
+	desc := f.message
+	if resp.Detail != "" {
+		desc += ": " + resp.Detail
+	}
+
+	if resp.ErrorCode != "" {
+		desc = fmt.Sprintf("%s (%s)", desc, resp.ErrorCode)
+	}
+
+	return apiresponses.NewFailureResponseBuilder(errors.New(desc), f.status, action).WithErrorKey(f.key).Build()
+}
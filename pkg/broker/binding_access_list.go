@@ -0,0 +1,152 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+// bindingCommentPrefix marks access list entries which belong to a binding
+// rather than the plan, followed by the binding ID.
+const bindingCommentPrefix = "atlas-osb binding "
+
+func bindingAccessListComment(bindingID string) string {
+	return bindingCommentPrefix + bindingID
+}
+
+// isBindingAccessListEntry reports whether the entry was added by a binding.
+func isBindingAccessListEntry(entry mongodbatlas.ProjectIPAccessList) bool {
+	return strings.HasPrefix(entry.Comment, bindingCommentPrefix)
+}
+
+// accessListFromParams returns the CIDR blocks passed to bind as accessList.
+func accessListFromParams(rawParams []byte) ([]string, error) {
+	params := struct {
+		AccessList []string `json:"accessList"`
+	}{}
+
+	if len(rawParams) > 0 {
+		if err := json.Unmarshal(rawParams, &params); err != nil {
+			return nil, errors.Wrap(err, "cannot unmarshal raw parameters")
+		}
+	}
+
+	cidrs := make([]string, 0, len(params.AccessList))
+	for _, c := range params.AccessList {
+		_, ipNet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid accessList entry %q", c)
+		}
+
+		cidrs = append(cidrs, ipNet.String())
+	}
+
+	return cidrs, nil
+}
+
+// createBindingAccessList adds the CIDR blocks to the access list of the
+// project on behalf of the binding. Blocks which the plan or the user already
+// put on the list are left alone, so that unbind doesn't remove entries it
+// doesn't own. Blocks which another binding added are shared with it. The
+// blocks the binding depends on are returned.
+func createBindingAccessList(ctx context.Context, client *mongodbatlas.Client, projectID string, bindingID string, cidrs []string) ([]string, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+
+	existing, _, err := client.ProjectIPAccessList.List(ctx, projectID, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get IP Access Lists from Atlas")
+	}
+
+	listed := map[string]mongodbatlas.ProjectIPAccessList{}
+	for _, e := range existing.Results {
+		listed[e.CIDRBlock] = e
+	}
+
+	entries := []*mongodbatlas.ProjectIPAccessList{}
+	owned := []string{}
+	for _, c := range cidrs {
+		if e, ok := listed[c]; ok {
+			if isBindingAccessListEntry(e) {
+				owned = append(owned, c)
+			}
+
+			continue
+		}
+
+		entries = append(entries, &mongodbatlas.ProjectIPAccessList{CIDRBlock: c, Comment: bindingAccessListComment(bindingID)})
+		owned = append(owned, c)
+	}
+
+	if len(entries) > 0 {
+		if _, _, err := client.ProjectIPAccessList.Create(ctx, projectID, entries); err != nil {
+			return nil, errors.Wrap(err, "cannot add binding to IP Access List")
+		}
+	}
+
+	return owned, nil
+}
+
+// deleteBindingAccessList removes the binding entries for the CIDR blocks
+// from the access list, except for those still used by other bindings.
+func deleteBindingAccessList(ctx context.Context, client *mongodbatlas.Client, projectID string, cidrs []string, inUse map[string]bool) error {
+	entries, _, err := client.ProjectIPAccessList.List(ctx, projectID, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot get IP Access Lists from Atlas")
+	}
+
+	listed := map[string]mongodbatlas.ProjectIPAccessList{}
+	for _, e := range entries.Results {
+		listed[e.CIDRBlock] = e
+	}
+
+	for _, c := range cidrs {
+		if e, ok := listed[c]; !ok || inUse[c] || !isBindingAccessListEntry(e) {
+			continue
+		}
+
+		if err := ignoreNotFound(client.ProjectIPAccessList.Delete(ctx, projectID, c)); err != nil {
+			return errors.Wrapf(err, "cannot delete %s from IP Access List", c)
+		}
+	}
+
+	return nil
+}
+
+// bindingAccessList returns the CIDR blocks which the bindings of the
+// instance other than except still use. Expired bindings don't count, their
+// entries go away when they are swept.
+func (s *instanceState) bindingAccessList(now time.Time, except string) map[string]bool {
+	inUse := map[string]bool{}
+	for id, bd := range s.Bindings {
+		if id == except || bd.expired(now) {
+			continue
+		}
+
+		for _, c := range bd.AccessList {
+			inUse[c] = true
+		}
+	}
+
+	return inUse
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+const (
+	authDBExternal = "$external"
+
+	x509TypeManaged = "MANAGED"
+	awsIAMTypeRole  = "ROLE"
+	// defaultCertificateMonths is how long generated client certificates are
+	// valid, unless certificateValidityMonths is passed to bind.
+	defaultCertificateMonths = 3
+	// maxCertificateMonths is the longest validity Atlas accepts.
+	maxCertificateMonths = 24
+)
+
+// isX509User reports whether the user authenticates with a client certificate.
+func isX509User(user *mongodbatlas.DatabaseUser) bool {
+	return user.X509Type != "" && user.X509Type != "NONE"
+}
+
+// isAWSIAMUser reports whether the user authenticates with AWS IAM.
+func isAWSIAMUser(user *mongodbatlas.DatabaseUser) bool {
+	return user.AWSIAMType != "" && user.AWSIAMType != "NONE"
+}
+
+// isLDAPUser reports whether the user is an LDAP user or group.
+func isLDAPUser(user *mongodbatlas.DatabaseUser) bool {
+	return user.LDAPAuthType != "" && user.LDAPAuthType != "NONE"
+}
+
+// hasPassword reports whether the user authenticates with a password
+// generated by the broker.
+func hasPassword(user *mongodbatlas.DatabaseUser) bool {
+	return !isX509User(user) && !isAWSIAMUser(user) && !isLDAPUser(user)
+}
+
+// prepareExternalUser checks a user which is authenticated by something other
+// than a password and moves it to the $external auth database.
+func prepareExternalUser(user *mongodbatlas.DatabaseUser) error {
+	if isX509User(user) && user.X509Type != x509TypeManaged {
+		return fmt.Errorf("x509Type %q is not supported, only %q", user.X509Type, x509TypeManaged)
+	}
+
+	if isAWSIAMUser(user) {
+		if user.AWSIAMType != awsIAMTypeRole {
+			return fmt.Errorf("awsIAMType %q is not supported, only %q", user.AWSIAMType, awsIAMTypeRole)
+		}
+
+		if !strings.HasPrefix(user.Username, "arn:aws:iam::") {
+			return errors.New("awsIAMRoleARN must be set to the ARN of an IAM role")
+		}
+	}
+
+	if isLDAPUser(user) && user.LDAPAuthType != "USER" && user.LDAPAuthType != "GROUP" {
+		return fmt.Errorf("ldapAuthType %q is not supported, only USER or GROUP", user.LDAPAuthType)
+	}
+
+	if !hasPassword(user) {
+		user.Password = ""
+		user.DatabaseName = authDBExternal
+	}
+
+	return nil
+}
+
+// authMechanism returns the authMechanism option for the connection string of
+// the user, or "" for SCRAM.
+func authMechanism(user *mongodbatlas.DatabaseUser) string {
+	switch {
+	case isX509User(user):
+		return "MONGODB-X509"
+	case isAWSIAMUser(user):
+		return "MONGODB-AWS"
+	case isLDAPUser(user):
+		return "PLAIN"
+	default:
+		return ""
+	}
+}
+
+// setUserCredentials puts the credentials of user into the connection string
+// cs and the connection details.
+func setUserCredentials(cs *url.URL, user *mongodbatlas.DatabaseUser, details *ConnectionDetails) {
+	mechanism := authMechanism(user)
+	if mechanism == "" {
+		cs.User = url.UserPassword(user.Username, user.Password)
+		details.Password = user.Password
+
+		return
+	}
+
+	// LDAP users log in with their own password, but the connection string
+	// names them. Members of an LDAP group use their own usernames.
+	if isLDAPUser(user) && user.LDAPAuthType == "USER" {
+		cs.User = url.User(user.Username)
+	}
+
+	// drivers expect "$external" as it is, url.Values would escape it
+	opts := "authMechanism=" + mechanism + "&authSource=" + authDBExternal
+	if cs.RawQuery != "" {
+		opts = cs.RawQuery + "&" + opts
+	}
+
+	cs.RawQuery = opts
+}
+
+// certificateMonths returns the validity of client certificates requested in
+// the bind parameters. It must be checked before the user is created, as Atlas
+// only rejects it when the certificate is generated.
+func certificateMonths(rawParams []byte) (int, error) {
+	params := struct {
+		Months int `json:"certificateValidityMonths"`
+	}{}
+
+	if len(rawParams) > 0 {
+		if err := json.Unmarshal(rawParams, &params); err != nil {
+			return 0, errors.Wrap(err, "cannot unmarshal raw parameters")
+		}
+	}
+
+	switch {
+	case params.Months == 0:
+		return defaultCertificateMonths, nil
+	case params.Months < 0 || params.Months > maxCertificateMonths:
+		return 0, invalidBindParameters(fmt.Errorf("certificateValidityMonths must be between 1 and %d", maxCertificateMonths))
+	}
+
+	return params.Months, nil
+}
+
+// createUserCertificate has Atlas generate a client certificate for the X.509
+// user and returns it with its private key, both PEM encoded.
+func createUserCertificate(ctx context.Context, client *mongodbatlas.Client, projectID string, username string, months int) (cert string, key string, err error) {
+	uc, _, err := client.X509AuthDBUsers.CreateUserCertificate(ctx, projectID, username, months)
+	if err != nil {
+		return "", "", errors.Wrap(err, "cannot create user certificate")
+	}
+
+	cert, key = splitPEM(uc.Certificate)
+	if cert == "" || key == "" {
+		return "", "", errors.New("user certificate from Atlas lacks the certificate or the private key")
+	}
+
+	return cert, key, nil
+}
+
+// splitPEM separates the certificates and the private key in data.
+func splitPEM(data string) (certs string, key string) {
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return
+		}
+
+		encoded := string(pem.EncodeToMemory(block))
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key += encoded
+		} else {
+			certs += encoded
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+// Connection string variants which can be chosen at bind time. Private
+// endpoint variants are named "<variant>/<endpoint ID>" in the list of all
+// variants.
+const (
+	connStandard           = "standard"
+	connStandardSrv        = "standardSrv"
+	connPrivate            = "private"
+	connPrivateSrv         = "privateSrv"
+	connPrivateEndpoint    = "privateEndpoint"
+	connPrivateEndpointSrv = "privateEndpointSrv"
+
+	// analyticsOptions route reads to the analytics nodes of the cluster.
+	analyticsOptions = "readPreference=secondary&readPreferenceTags=nodeType:ANALYTICS"
+)
+
+// bindingConnection holds the connection string chosen for a binding and, if
+// all of them were requested, every variant of the cluster by name.
+type bindingConnection struct {
+	name      string
+	selected  string
+	variants  map[string]string
+	analytics bool
+}
+
+// connectionFromParams picks the connection string variant requested in the
+// bind parameters. Without parameters the private endpoint is used if the
+// cluster has exactly one, otherwise the standard SRV connection string.
+func connectionFromParams(rawParams []byte, cs *mongodbatlas.ConnectionStrings) (*bindingConnection, error) {
+	params := struct {
+		Variant           string `json:"connectionString"`
+		PrivateEndpointID string `json:"privateEndpointID"`
+		Analytics         bool   `json:"analytics"`
+		All               bool   `json:"allConnectionStrings"`
+	}{}
+
+	if len(rawParams) > 0 {
+		if err := json.Unmarshal(rawParams, &params); err != nil {
+			return nil, errors.Wrap(err, "cannot unmarshal raw parameters")
+		}
+	}
+
+	if cs == nil {
+		cs = &mongodbatlas.ConnectionStrings{}
+	}
+
+	variants := connectionVariants(cs)
+	endpoints := privateEndpointIDs(cs)
+	conn := &bindingConnection{name: params.Variant, analytics: params.Analytics}
+
+	switch params.Variant {
+	case "":
+		if params.PrivateEndpointID != "" {
+			id, err := selectPrivateEndpoint(endpoints, params.PrivateEndpointID)
+			if err != nil {
+				return nil, err
+			}
+
+			// the endpoint may only have the standard connection string
+			conn.name = connPrivateEndpointSrv + "/" + id
+			if variants[conn.name] == "" {
+				conn.name = connPrivateEndpoint + "/" + id
+			}
+
+			break
+		}
+
+		conn.name = connStandardSrv
+		if len(endpoints) == 1 && variants[connPrivateEndpointSrv+"/"+endpoints[0]] != "" {
+			conn.name = connPrivateEndpointSrv + "/" + endpoints[0]
+		}
+
+	case connStandard, connStandardSrv, connPrivate, connPrivateSrv:
+		if params.PrivateEndpointID != "" {
+			return nil, invalidBindParameters(fmt.Errorf("privateEndpointID can't be used with the %s connection string", params.Variant))
+		}
+
+	case connPrivateEndpoint, connPrivateEndpointSrv:
+		id, err := selectPrivateEndpoint(endpoints, params.PrivateEndpointID)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.name = params.Variant + "/" + id
+
+	default:
+		return nil, invalidBindParameters(fmt.Errorf("unknown connectionString %q, must be one of %s", params.Variant,
+			strings.Join([]string{connStandard, connStandardSrv, connPrivate, connPrivateSrv, connPrivateEndpoint, connPrivateEndpointSrv}, ", ")))
+	}
+
+	if conn.selected == "" {
+		conn.selected = variants[conn.name]
+	}
+
+	if conn.selected == "" {
+		return nil, fmt.Errorf("the cluster has no %s connection string", conn.name)
+	}
+
+	if _, err := url.Parse(conn.selected); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s connection string", conn.name)
+	}
+
+	if params.All {
+		conn.variants = map[string]string{}
+		for name, s := range variants {
+			if _, err := url.Parse(s); err == nil {
+				conn.variants[name] = s
+			}
+		}
+	}
+
+	return conn, nil
+}
+
+// connectionVariants returns all connection strings of a cluster by name.
+func connectionVariants(cs *mongodbatlas.ConnectionStrings) map[string]string {
+	variants := map[string]string{}
+	add := func(name string, s string) {
+		if s != "" {
+			variants[name] = s
+		}
+	}
+
+	add(connStandard, cs.Standard)
+	add(connStandardSrv, cs.StandardSrv)
+	add(connPrivate, cs.Private)
+	add(connPrivateSrv, cs.PrivateSrv)
+
+	for _, pe := range cs.PrivateEndpoint {
+		for _, e := range pe.Endpoints {
+			add(connPrivateEndpoint+"/"+e.EndpointID, pe.ConnectionString)
+			add(connPrivateEndpointSrv+"/"+e.EndpointID, pe.SRVConnectionString)
+		}
+	}
+
+	return variants
+}
+
+// privateEndpointIDs returns the sorted IDs of all private endpoints of a
+// cluster.
+func privateEndpointIDs(cs *mongodbatlas.ConnectionStrings) []string {
+	ids := []string{}
+	seen := map[string]bool{}
+
+	for _, pe := range cs.PrivateEndpoint {
+		for _, e := range pe.Endpoints {
+			if e.EndpointID != "" && !seen[e.EndpointID] {
+				seen[e.EndpointID] = true
+				ids = append(ids, e.EndpointID)
+			}
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// selectPrivateEndpoint checks the requested endpoint ID against those of the
+// cluster. Without an ID the only endpoint is used, it is required if there
+// are several.
+func selectPrivateEndpoint(endpoints []string, id string) (string, error) {
+	switch {
+	case len(endpoints) == 0:
+		return "", invalidBindParameters(errors.New("the cluster has no private endpoints"))
+
+	case id == "" && len(endpoints) == 1:
+		return endpoints[0], nil
+
+	case id == "":
+		return "", invalidBindParameters(fmt.Errorf("the cluster has several private endpoints, privateEndpointID must be one of %s",
+			strings.Join(endpoints, ", ")))
+	}
+
+	for _, e := range endpoints {
+		if e == id {
+			return id, nil
+		}
+	}
+
+	return "", invalidBindParameters(fmt.Errorf("unknown privateEndpointID %q, must be one of %s", id, strings.Join(endpoints, ", ")))
+}
+
+// uri returns the connection string raw for user and database, with the
+// options of the connection.
+func (conn *bindingConnection) uri(raw string, database string, user *mongodbatlas.DatabaseUser, details *ConnectionDetails) (*url.URL, error) {
+	cs, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse connection string")
+	}
+
+	cs.Path = database
+
+	if conn.analytics {
+		if cs.RawQuery != "" {
+			cs.RawQuery += "&"
+		}
+
+		// url.Values would escape the colon of the tag
+		cs.RawQuery += analyticsOptions
+	}
+
+	setUserCredentials(cs, user, details)
+
+	return cs, nil
+}
+
+// allURIs returns every variant for user and database, or nil if they
+// weren't requested.
+func (conn *bindingConnection) allURIs(database string, user *mongodbatlas.DatabaseUser, details *ConnectionDetails) (map[string]string, error) {
+	if conn.variants == nil {
+		return nil, nil
+	}
+
+	uris := map[string]string{}
+	for name, raw := range conn.variants {
+		cs, err := conn.uri(raw, database, user, details)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s connection string", name)
+		}
+
+		uris[name] = cs.String()
+	}
+
+	return uris, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
+	"github.com/pkg/errors"
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+// renderCredentials renders the bindingCredentials template of the plan. A
+// nil map means the plan has none and connDetails are used as they are.
+func renderCredentials(p *dynamicplans.Plan, user *mongodbatlas.DatabaseUser, cluster *mongodbatlas.Cluster, connDetails ConnectionDetails) (map[string]interface{}, error) {
+	if p.BindingCredentials == "" {
+		return nil, nil
+	}
+
+	tpl, err := dynamicplans.NewTemplate("bindingCredentials", p.BindingCredentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid bindingCredentials")
+	}
+
+	hosts, replicaSet := clusterHosts(cluster)
+
+	raw := new(bytes.Buffer)
+	err = tpl.Execute(raw, dynamicplans.Context{
+		"user":              user,
+		"cluster":           cluster,
+		"connectionStrings": cluster.ConnectionStrings,
+		"details":           connDetails,
+		"hosts":             hosts,
+		"replicaSet":        replicaSet,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot render bindingCredentials")
+	}
+
+	if strings.TrimSpace(raw.String()) == "" {
+		return nil, errors.New("bindingCredentials rendered an empty template")
+	}
+
+	// values are only safe to parse if the template quoted them with toJson,
+	// see the README
+	var creds map[string]interface{}
+	if err := yaml.NewDecoder(raw).Decode(&creds); err != nil {
+		return nil, errors.Wrap(err, "bindingCredentials must render to a map")
+	}
+
+	if creds == nil {
+		return nil, errors.New("bindingCredentials must render to a map")
+	}
+
+	// make sure the credentials can be stored and returned as JSON
+	if _, err := json.Marshal(creds); err != nil {
+		return nil, errors.Wrap(err, "bindingCredentials must render to a map with string keys")
+	}
+
+	return creds, nil
+}
+
+// clusterHosts returns the host:port pairs and the replica set name from the
+// standard connection string of the cluster.
+func clusterHosts(cluster *mongodbatlas.Cluster) (hosts []string, replicaSet string) {
+	if cluster.ConnectionStrings == nil {
+		return nil, ""
+	}
+
+	cs, err := url.Parse(cluster.ConnectionStrings.Standard)
+	if err != nil || cs.Host == "" {
+		return nil, ""
+	}
+
+	return strings.Split(cs.Host, ","), cs.Query().Get("replicaSet")
+}
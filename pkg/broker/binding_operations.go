@@ -20,9 +20,12 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"net/http"
+	"reflect"
+	"time"
 
 	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
+	"github.com/mongodb/atlas-osb/pkg/broker/statestorage"
 	"github.com/pivotal-cf/brokerapi/domain"
 	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
 	"github.com/pkg/errors"
@@ -32,15 +35,61 @@ import (
 const (
 	overrideBindDB     = "overrideBindDB"
 	overrideBindDBRole = "overrideBindDBRole"
+	// asyncBind makes bindings wait until the new user has been applied to
+	// the cluster, if the platform accepts asynchronous bindings.
+	asyncBind = "asyncBind"
+
+	// maxBindingTTL is the longest Atlas keeps temporary users.
+	maxBindingTTL = 7 * 24 * time.Hour
 )
 
 // ConnectionDetails will be returned when a new binding is created.
 type ConnectionDetails struct {
 	Username         string `json:"username"`
-	Password         string `json:"password"`
+	Password         string `json:"password,omitempty"`
 	URI              string `json:"uri"`
 	ConnectionString string `json:"connectionString"`
 	Database         string `json:"database"`
+	// Certificate and PrivateKey are set for X.509 users, PEM encoded.
+	Certificate string `json:"certificate,omitempty"`
+	PrivateKey  string `json:"privateKey,omitempty"`
+	// ExpiresAt is when Atlas deletes the user of a temporary binding.
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	// ConnectionStrings are all variants by name, if requested.
+	ConnectionStrings map[string]string `json:"connectionStrings,omitempty"`
+}
+
+// binding is what the broker keeps about a binding in the instance state.
+type binding struct {
+	Username  string               `json:"username"`
+	AuthDB    string               `json:"authDB"`
+	Roles     []mongodbatlas.Role  `json:"roles,omitempty"`
+	Scopes    []mongodbatlas.Scope `json:"scopes,omitempty"`
+	CreatedAt time.Time            `json:"createdAt"`
+	// ConnectionTemplate is the connection string without credentials.
+	ConnectionTemplate string `json:"connectionTemplate"`
+	// AccessList are the CIDR blocks added to the project for the binding.
+	AccessList  []string          `json:"accessList,omitempty"`
+	ExpiresAt   *time.Time        `json:"expiresAt,omitempty"`
+	Parameters  json.RawMessage   `json:"parameters,omitempty"`
+	Credentials ConnectionDetails `json:"credentials"`
+	// CustomCredentials are rendered from the bindingCredentials template of
+	// the plan and replace Credentials for the platform.
+	CustomCredentials map[string]interface{} `json:"customCredentials,omitempty"`
+	Operation         *operation             `json:"operation,omitempty"`
+}
+
+// credentials returns what the platform gets as credentials of the binding.
+func (bd *binding) credentials() interface{} {
+	if bd.CustomCredentials != nil {
+		return bd.CustomCredentials
+	}
+
+	return bd.Credentials
+}
+
+func (bd *binding) expired(now time.Time) bool {
+	return bd.ExpiresAt != nil && now.After(*bd.ExpiresAt)
 }
 
 // Bind will create a new database user with a username matching the binding ID
@@ -49,7 +98,17 @@ func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, d
 	logger := b.funcLogger().With("instance_id", instanceID, "binding_id", bindingID)
 	logger.Infow("Creating binding", "details", details)
 
-	client, p, err := b.getClient(ctx, instanceID, details.PlanID, nil)
+	defer func() { err = translateAtlasError(err, "bind") }()
+
+	s, err := b.getInstanceState(ctx, instanceID)
+	if err != nil {
+		logger.Errorw("Failed to get instance state", "error", err)
+
+		return
+	}
+
+	p := &s.Plan
+	client, err := b.getPlanClient(ctx, p)
 	if err != nil {
 		logger.Errorw("Failed to get existing client", "error", err)
 
@@ -68,6 +127,11 @@ func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, d
 		return spec, fmt.Errorf("plan ID %q not found in catalog", details.PlanID)
 	}
 
+	// a retried request must not create another user
+	if bd, ok := s.Bindings[bindingID]; ok && !bd.expired(time.Now()) {
+		return bindExisting(bd, details)
+	}
+
 	// Fetch the cluster from Atlas to ensure it exists.
 	cluster, _, err := client.Clusters.Get(ctx, p.Project.ID, p.Cluster.Name)
 	if err != nil {
@@ -92,6 +156,38 @@ func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, d
 		return
 	}
 
+	if err = checkIdentityUnused(s, bindingID, user.Username); err != nil {
+		return
+	}
+
+	months := 0
+	if isX509User(user) {
+		months, err = certificateMonths(details.RawParameters)
+		if err != nil {
+			return
+		}
+	}
+
+	cidrs, err := accessListFromParams(details.RawParameters)
+	if err != nil {
+		return
+	}
+
+	conn, err := connectionFromParams(details.RawParameters, cluster.ConnectionStrings)
+	if err != nil {
+		return
+	}
+
+	var expiresAt *time.Time
+	if user.DeleteAfterDate != "" {
+		t, errParse := time.Parse(time.RFC3339, user.DeleteAfterDate)
+		if errParse != nil {
+			return spec, errors.Wrap(errParse, "invalid deleteAfterDate")
+		}
+
+		expiresAt = &t
+	}
+
 	// Create a new Atlas database user from the generated definition.
 	_, _, err = client.DatabaseUsers.Create(ctx, p.Project.ID, user)
 	if err != nil {
@@ -102,60 +198,234 @@ func (b Broker) Bind(ctx context.Context, instanceID string, bindingID string, d
 
 	logger.Infow("Successfully created Atlas database user")
 
-	cs, err := url.Parse(cluster.ConnectionStrings.StandardSrv)
-	if len(cluster.ConnectionStrings.PrivateEndpoint) != 0 {
-		logger.Infow("Using private connection string")
-		for _, e := range cluster.ConnectionStrings.PrivateEndpoint {
-			cs, err = url.Parse(e.SRVConnectionString)
-			if err != nil {
-				logger.Errorw("Failed to parse private connection string", "error", err)
+	connDetails := ConnectionDetails{
+		Username:  user.Username,
+		ExpiresAt: user.DeleteAfterDate,
+	}
 
-				continue
-			}
+	if isX509User(user) {
+		connDetails.Certificate, connDetails.PrivateKey, err = createUserCertificate(ctx, client, p.Project.ID, user.Username, months)
+	}
 
-			break
-		}
+	inUse := s.bindingAccessList(time.Now(), bindingID)
+
+	var accessList []string
+	if err == nil {
+		accessList, err = createBindingAccessList(ctx, client, p.Project.ID, bindingID, cidrs)
 	}
+
 	if err != nil {
-		logger.Errorw("Failed to parse connection strings", "error", err,
-			"standard", cluster.ConnectionStrings.StandardSrv)
+		logger.Errorw("Failed to set up binding, deleting the user again", "error", err)
+		b.undoBinding(ctx, client, p.Project.ID, bindingID, user.GetAuthDB(), user.Username, accessList, inUse)
 
 		return
 	}
 
-	cs.Path = user.DatabaseName
-
-	connDetails := ConnectionDetails{
-		Username: bindingID,
-		Password: password,
+	database := user.DatabaseName
+	if len(user.Roles) > 0 {
+		database = user.Roles[0].DatabaseName
+		logger.Infow("Detected roles, override the name of the db to connect", "database", database)
 	}
 
-	if len(user.Roles) > 0 {
-		cs.Path = user.Roles[0].DatabaseName
-		logger.Infow("Detected roles, override the name of the db to connect", "connectionString", cs)
+	logger.Infow("Using connection string", "variant", conn.name, "analytics", conn.analytics)
+
+	cs, err := conn.uri(conn.selected, database, user, &connDetails)
+	if err == nil {
+		connDetails.ConnectionStrings, err = conn.allURIs(database, user, &connDetails)
 	}
 
-	logger.Infow("New User ConnectionString", "connectionString", cs)
+	if err != nil {
+		logger.Errorw("Failed to build connection strings, deleting the user again", "error", err)
+		b.undoBinding(ctx, client, p.Project.ID, bindingID, user.GetAuthDB(), user.Username, accessList, inUse)
+
+		return
+	}
 
-	cs.User = url.UserPassword(user.Username, user.Password)
 	connDetails.ConnectionString = cs.String()
 	connDetails.Database = cs.Path
 	connDetails.URI = cs.String()
 
-	spec = domain.Binding{
-		Credentials: connDetails,
+	customCreds, err := renderCredentials(p, user, cluster, connDetails)
+	if err != nil {
+		logger.Errorw("Failed to render binding credentials, deleting the user again", "error", err)
+		b.undoBinding(ctx, client, p.Project.ID, bindingID, user.GetAuthDB(), user.Username, accessList, inUse)
+
+		return
+	}
+
+	template := *cs
+	template.User = nil
+
+	bd := &binding{
+		Username:           user.Username,
+		AuthDB:             user.GetAuthDB(),
+		Roles:              user.Roles,
+		Scopes:             user.Scopes,
+		CreatedAt:          time.Now().UTC(),
+		ConnectionTemplate: template.String(),
+		AccessList:         accessList,
+		ExpiresAt:          expiresAt,
+		Parameters:         details.RawParameters,
+		Credentials:        connDetails,
+		CustomCredentials:  customCreds,
+	}
+
+	// asynchronous bindings are done once the user is applied to the cluster,
+	// the platform then gets the credentials with GetBinding
+	if async, _ := p.Settings[asyncBind].(bool); async && asyncAllowed {
+		bd.Operation = newOperation(operationBind)
+		bd.Operation.step(stepUsers, domain.Succeeded, "created", nil)
+		bd.Operation.step(stepPropagation, domain.InProgress, "waiting for the user to be applied to the cluster", nil)
+
+		spec = domain.Binding{
+			IsAsync:       true,
+			OperationData: bd.Operation.operationData(),
+		}
+	} else {
+		spec = domain.Binding{
+			Credentials: bd.credentials(),
+		}
+	}
+
+	if err = b.storeBinding(ctx, client, instanceID, bindingID, p, bd, inUse); err != nil {
+		spec = domain.Binding{}
+
+		return
+	}
+
+	// the reconciler sweeps the binding once it has expired
+	if expiresAt != nil {
+		b.reconciler.track(instanceID)
 	}
 
 	return
 }
 
+// bindExisting answers a bind request for a binding which already exists: a
+// repeated request gets the stored binding, anything else is a conflict.
+//
+// The OSB spec asks for 200 OK if the binding already exists, which brokerapi
+// v5 cannot send; it answers 201 Created with the same credentials instead.
+func bindExisting(bd *binding, details domain.BindDetails) (domain.Binding, error) {
+	same, err := sameParameters(bd.Parameters, details.RawParameters)
+	if err != nil {
+		return domain.Binding{}, err
+	}
+
+	if !same {
+		return domain.Binding{}, apiresponses.ErrBindingAlreadyExists
+	}
+
+	if bd.Operation != nil && bd.Operation.State != domain.Succeeded {
+		return domain.Binding{
+			IsAsync:       true,
+			OperationData: bd.Operation.operationData(),
+		}, nil
+	}
+
+	return domain.Binding{Credentials: bd.credentials()}, nil
+}
+
+// sameParameters compares two sets of raw parameters regardless of the order
+// of their keys.
+func sameParameters(a, b json.RawMessage) (bool, error) {
+	var va, vb interface{}
+
+	if len(a) > 0 {
+		if err := json.Unmarshal(a, &va); err != nil {
+			return false, errors.Wrap(err, "cannot unmarshal stored parameters")
+		}
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &vb); err != nil {
+			return false, errors.Wrap(err, "cannot unmarshal raw parameters")
+		}
+	}
+
+	return reflect.DeepEqual(va, vb), nil
+}
+
+// invalidBindParameters reports bind parameters which are rejected before
+// anything is created in Atlas.
+func invalidBindParameters(err error) error {
+	return apiresponses.NewFailureResponseBuilder(err, http.StatusBadRequest, "bind").WithErrorKey("InvalidParameters").Build()
+}
+
+// checkIdentityUnused rejects binding to a username which another binding
+// already uses, e.g. the same AWS IAM role or LDAP name. Atlas only allows one
+// database user per identity, and unbinding either would delete it for both.
+func checkIdentityUnused(s *instanceState, bindingID string, username string) error {
+	for id, bd := range s.Bindings {
+		if id != bindingID && bd.Username == username && !bd.expired(time.Now()) {
+			return apiresponses.NewFailureResponseBuilder(
+				fmt.Errorf("binding %s already uses the database user %q, bind to a different identity", id, username),
+				http.StatusUnprocessableEntity, "bind",
+			).WithErrorKey("IdentityInUse").Build()
+		}
+	}
+
+	return nil
+}
+
+// storeBinding adds bd to the instance state. If that fails, the user is
+// deleted again, so that there are no bindings the broker doesn't know about.
+// Access list entries in inUse are kept for the other bindings.
+func (b Broker) storeBinding(ctx context.Context, client *mongodbatlas.Client, instanceID string, bindingID string, p *dynamicplans.Plan, bd *binding, inUse map[string]bool) error {
+	logger := b.funcLogger().With("instance_id", instanceID, "binding_id", bindingID)
+
+	err := b.modifyInstance(ctx, p.Project.OrgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, s *instanceState) error {
+		if s.Bindings == nil {
+			s.Bindings = map[string]*binding{}
+		}
+
+		s.Bindings[bindingID] = bd
+
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	logger.Errorw("Failed to store binding, deleting the user again", "error", err)
+	b.undoBinding(ctx, client, p.Project.ID, bindingID, bd.AuthDB, bd.Username, bd.AccessList, inUse)
+
+	return errors.Wrap(err, "cannot store binding")
+}
+
+// undoBinding removes what a failed bind has created in Atlas, except for the
+// access list entries in inUse.
+func (b Broker) undoBinding(ctx context.Context, client *mongodbatlas.Client, projectID string, bindingID string, authDB string, username string, accessList []string, inUse map[string]bool) {
+	logger := b.funcLogger().With("binding_id", bindingID)
+
+	if _, err := client.DatabaseUsers.Delete(ctx, authDB, projectID, username); err != nil {
+		logger.Errorw("Failed to delete Atlas database user", "error", err)
+	}
+
+	if len(accessList) == 0 {
+		return
+	}
+
+	if err := deleteBindingAccessList(ctx, client, projectID, accessList, inUse); err != nil {
+		logger.Errorw("Failed to delete IP Access List entries", "error", err)
+	}
+}
+
 // Unbind will delete the database user for a specific binding. The database
 // user should have the binding ID as its username.
 func (b Broker) Unbind(ctx context.Context, instanceID string, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (spec domain.UnbindSpec, err error) {
 	logger := b.funcLogger().With("instance_id", instanceID, "binding_id", bindingID)
 	logger.Infow("Releasing binding", "details", details)
 
-	client, p, err := b.getClient(ctx, instanceID, details.PlanID, nil)
+	s, err := b.getInstanceState(ctx, instanceID)
+	if err != nil {
+		logger.Errorw("Failed to get instance state", "error", err)
+
+		return
+	}
+
+	p := &s.Plan
+	client, err := b.getPlanClient(ctx, p)
 	if err != nil {
 		logger.Errorw("Failed to get existing client", "error", err)
 
@@ -170,36 +440,192 @@ func (b Broker) Unbind(ctx context.Context, instanceID string, bindingID string,
 		return
 	}
 
-	// Delete database user which has the binding ID as its username.
-	_, err = client.DatabaseUsers.Delete(ctx, "admin", p.Project.ID, bindingID)
-	if err != nil {
-		logger.Errorw("Failed to delete Atlas database user", "error", err)
+	bd, stored := s.Bindings[bindingID]
+
+	if stored && len(bd.AccessList) > 0 {
+		err = deleteBindingAccessList(ctx, client, p.Project.ID, bd.AccessList, s.bindingAccessList(time.Now(), bindingID))
+		if err != nil {
+			logger.Errorw("Failed to delete IP Access List entries", "error", err)
+
+			return
+		}
+	}
+
+	authDB, username := "", bindingID
+	if stored {
+		authDB, username = bd.AuthDB, bd.Username
+	} else {
+		// bindings created before they were stored
+		authDB, err = findUserAuthDB(ctx, client, p.Project.ID, bindingID)
+		if err != nil {
+			logger.Errorw("Failed to look up Atlas database user", "error", err)
+
+			return
+		}
+
+		if authDB == "" {
+			return spec, apiresponses.ErrBindingDoesNotExist
+		}
+	}
+
+	r, err := client.DatabaseUsers.Delete(ctx, authDB, p.Project.ID, username)
+	switch {
+	case err == nil:
+		logger.Infow("Successfully deleted Atlas database user", "authDB", authDB)
+	case r != nil && r.StatusCode == http.StatusNotFound:
+		logger.Infow("Atlas database user is already gone", "authDB", authDB)
+		err = nil
+	default:
+		logger.Errorw("Failed to delete Atlas database user", "error", err, "authDB", authDB)
+
+		return
+	}
 
+	if !stored {
 		return
 	}
 
-	logger.Infow("Successfully deleted Atlas database user")
+	err = b.modifyInstance(ctx, p.Project.OrgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, s *instanceState) error {
+		delete(s.Bindings, bindingID)
+
+		return nil
+	})
+	if err != nil {
+		logger.Errorw("Failed to remove the stored binding", "error", err)
+
+		return
+	}
 
 	spec = domain.UnbindSpec{}
 
 	return
 }
 
-// GetBinding is currently not supported as specified by the
-// BindingsRetrievable setting in the service catalog.
+// findUserAuthDB returns the auth database of the Atlas database user, or ""
+// if there is no such user in the project.
+func findUserAuthDB(ctx context.Context, client *mongodbatlas.Client, projectID string, username string) (string, error) {
+	const pageSize = 500
+
+	for page := 1; ; page++ {
+		users, _, err := client.DatabaseUsers.List(ctx, projectID, &mongodbatlas.ListOptions{PageNum: page, ItemsPerPage: pageSize})
+		if err != nil {
+			return "", errors.Wrap(err, "cannot list database users")
+		}
+
+		for i := range users {
+			if users[i].Username == username {
+				return users[i].GetAuthDB(), nil
+			}
+		}
+
+		if len(users) < pageSize {
+			return "", nil
+		}
+	}
+}
+
+// GetBinding returns the credentials and parameters of a stored binding. Bindings
+// created before they were stored can't be retrieved.
 func (b Broker) GetBinding(ctx context.Context, instanceID string, bindingID string) (spec domain.GetBindingSpec, err error) {
 	logger := b.funcLogger().With("instance_id", instanceID, "binding_id", bindingID)
 	logger.Infow("Retrieving binding")
 
-	err = apiresponses.NewFailureResponse(fmt.Errorf("unknown binding ID %s", bindingID), 404, "get-binding")
+	s, err := b.getInstanceState(ctx, instanceID)
+	if err != nil {
+		return
+	}
+
+	bd, ok := s.Bindings[bindingID]
+	if !ok || (bd.Operation != nil && bd.Operation.State != domain.Succeeded) || bd.expired(time.Now()) {
+		err = apiresponses.NewFailureResponse(fmt.Errorf("unknown binding ID %s", bindingID), 404, "get-binding")
+
+		return
+	}
+
+	spec.Credentials = bd.credentials()
+	if len(bd.Parameters) > 0 {
+		spec.Parameters = bd.Parameters
+	}
 
 	return
 }
 
-// LastBindingOperation should fetch the status of the last creation/deletion
-// of a database user.
-func (b Broker) LastBindingOperation(ctx context.Context, instanceID string, bindingID string, details domain.PollDetails) (domain.LastOperation, error) {
-	panic("not implemented")
+// LastBindingOperation reports whether the user of an asynchronous binding has
+// been applied to the cluster yet.
+func (b Broker) LastBindingOperation(ctx context.Context, instanceID string, bindingID string, details domain.PollDetails) (resp domain.LastOperation, err error) {
+	logger := b.funcLogger().With("instance_id", instanceID, "binding_id", bindingID)
+	logger.Infow("Fetching state of last binding operation", "details", details)
+
+	s, err := b.getInstanceState(ctx, instanceID)
+	if err != nil {
+		if errors.Is(err, statestorage.ErrInstanceNotFound) {
+			err = apiresponses.ErrBindingDoesNotExist
+		}
+
+		return
+	}
+
+	bd, ok := s.Bindings[bindingID]
+	if !ok || bd.Operation == nil {
+		return resp, apiresponses.ErrBindingDoesNotExist
+	}
+
+	op := bd.Operation
+	if _, opID := parseOperationData(details.OperationData); opID != op.ID {
+		resp.State = domain.Failed
+		resp.Description = fmt.Sprintf("operation %s is not the last operation of the binding", opID)
+
+		return
+	}
+
+	if op.State == domain.InProgress {
+		if err = b.checkBindingPropagation(ctx, &s.Plan, op); err != nil {
+			return
+		}
+
+		err = b.modifyInstance(ctx, s.Plan.Project.OrgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, stored *instanceState) error {
+			if current, ok := stored.Bindings[bindingID]; ok && current.Operation != nil && current.Operation.ID == op.ID {
+				current.Operation = op
+			}
+
+			return nil
+		})
+		if err != nil {
+			logger.Errorw("Failed to store binding operation", "error", err)
+
+			return
+		}
+	}
+
+	resp.State = op.State
+	resp.Description = op.description()
+
+	return
+}
+
+// checkBindingPropagation completes op once Atlas reports that all changes to
+// the project have been applied to the cluster.
+func (b Broker) checkBindingPropagation(ctx context.Context, p *dynamicplans.Plan, op *operation) error {
+	client, err := b.getPlanClient(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	status, _, err := client.Clusters.Status(ctx, p.Project.ID, p.Cluster.Name)
+	if err != nil {
+		return errors.Wrap(err, "cannot get cluster status")
+	}
+
+	if status.ChangeStatus == mongodbatlas.ChangeStatusApplied {
+		op.step(stepPropagation, domain.Succeeded, "applied", nil)
+
+		return nil
+	}
+
+	op.step(stepPropagation, domain.InProgress, string(status.ChangeStatus), nil)
+	b.checkDeadline(p, op)
+
+	return nil
 }
 
 // generatePassword will generate a cryptographically secure password.
@@ -220,9 +646,13 @@ func (b *Broker) userFromParams(bindingID string, password string, rawParams []b
 	logger := b.funcLogger().With("binding_id", bindingID)
 	// Set up a params object which will be used for deserialization.
 	params := struct {
-		User *mongodbatlas.DatabaseUser `json:"user"`
+		User          *mongodbatlas.DatabaseUser `json:"user"`
+		AWSIAMRoleARN string                     `json:"awsIAMRoleARN"`
+		LDAPAuthType  string                     `json:"ldapAuthType"`
+		LDAPName      string                     `json:"ldapName"`
+		TTL           string                     `json:"ttl"`
 	}{
-		&mongodbatlas.DatabaseUser{},
+		User: &mongodbatlas.DatabaseUser{},
 	}
 
 	// If params were passed we unmarshal them into the params object.
@@ -236,6 +666,44 @@ func (b *Broker) userFromParams(bindingID string, password string, rawParams []b
 	// Set binding ID as username and add password.
 	params.User.Username = bindingID
 	params.User.Password = password
+
+	// IAM users are named after the role
+	if params.AWSIAMRoleARN != "" {
+		params.User.Username = params.AWSIAMRoleARN
+		params.User.AWSIAMType = awsIAMTypeRole
+	}
+
+	// LDAP users and groups are named after their distinguished name
+	if params.LDAPAuthType != "" {
+		params.User.LDAPAuthType = params.LDAPAuthType
+	}
+
+	if isLDAPUser(params.User) {
+		if params.LDAPName == "" {
+			return nil, errors.New("ldapName must be set to the LDAP user or group")
+		}
+
+		params.User.Username = params.LDAPName
+	}
+
+	if err := prepareExternalUser(params.User); err != nil {
+		return nil, err
+	}
+
+	// Atlas deletes temporary users on its own
+	if params.TTL != "" {
+		ttl, err := time.ParseDuration(params.TTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ttl")
+		}
+
+		if ttl <= 0 || ttl > maxBindingTTL {
+			return nil, fmt.Errorf("ttl must be positive and at most %s", maxBindingTTL)
+		}
+
+		params.User.DeleteAfterDate = time.Now().UTC().Add(ttl).Format(time.RFC3339)
+	}
+
 	if len(params.User.DatabaseName) == 0 {
 		logger.Warn(`No auth "databaseName" in User, setting to "admin" for Atlas.`)
 		params.User.DatabaseName = "admin"
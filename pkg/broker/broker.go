@@ -17,18 +17,19 @@ package broker
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/Sectorbob/mlab-ns2/gae/ns/digest"
 	"github.com/goccy/go-yaml"
 	"github.com/gorilla/mux"
 	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
 	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
+	"github.com/mongodb/atlas-osb/pkg/broker/encryption"
 	"github.com/mongodb/atlas-osb/pkg/broker/statestorage"
 	"github.com/pivotal-cf/brokerapi/domain"
 	"github.com/pkg/errors"
@@ -48,6 +49,9 @@ type Broker struct {
 	cfg         Config
 	catalog     *catalog
 	userAgent   string
+	state       *statestorage.Index
+	keyring     *encryption.Keyring
+	reconciler  *reconciler
 }
 
 type Config struct {
@@ -65,14 +69,46 @@ type Config struct {
 	DocumentationURL    string
 	ProviderDisplayName string
 	LongDescription     string
+	StateStorage        string
+	StateStorageURI     string
+	StateStorageDB      string
+	StateIndexRefresh   time.Duration
+	StateEncryptionKeys string
+	// MaxOperationDuration applies to plans which don't set maxDuration.
+	MaxOperationDuration time.Duration
+	// ReconcilerWorkers is the number of instances whose operations are
+	// driven concurrently in the background, at least 1.
+	ReconcilerWorkers int
+	ReconcileInterval time.Duration
 }
 
-// New creates a new Broker with a logger.
+// New creates a new Broker with a logger and starts refreshing the state index
+// and reconciling instances in the background.
 func New(
 	logger *zap.SugaredLogger,
 	credentials *credentials.Credentials,
 	cfg Config,
 	userAgent string,
+) *Broker {
+	b := NewWithoutWorkers(logger, credentials, cfg, userAgent)
+
+	if credentials != nil {
+		go b.state.Run(context.Background(), credentials.Keys(), cfg.StateIndexRefresh)
+
+		b.reconciler = newReconciler(b, cfg.ReconcilerWorkers, cfg.ReconcileInterval)
+		go b.reconciler.Run(context.Background())
+	}
+
+	return b
+}
+
+// NewWithoutWorkers creates a Broker for one-off commands, which doesn't start
+// any background work.
+func NewWithoutWorkers(
+	logger *zap.SugaredLogger,
+	credentials *credentials.Credentials,
+	cfg Config,
+	userAgent string,
 ) *Broker {
 	b := &Broker{
 		logger:      logger,
@@ -83,6 +119,20 @@ func New(
 
 	b.buildCatalog()
 
+	keyring, err := encryption.ParseKeyring(cfg.StateEncryptionKeys)
+	if err != nil {
+		logger.Fatalw("could not parse state encryption keys", "error", err)
+	}
+
+	b.keyring = keyring
+
+	state, err := NewStateBackend(context.Background(), logger, cfg, userAgent)
+	if err != nil {
+		logger.Fatalw("could not set up state storage", "backend", cfg.StateStorage, "error", err)
+	}
+
+	b.state = statestorage.NewIndex(state, logger)
+
 	return b
 }
 
@@ -138,7 +188,7 @@ func (b *Broker) parsePlan(ctx dynamicplans.Context, planID string) (dp *dynamic
 	return dp, nil
 }
 
-func (b *Broker) getInstancePlan(ctx context.Context, instanceID string) (*dynamicplans.Plan, error) {
+func (b *Broker) getInstanceState(ctx context.Context, instanceID string) (*instanceState, error) {
 	i, err := b.getInstance(ctx, instanceID)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot fetch instance")
@@ -149,45 +199,23 @@ func (b *Broker) getInstancePlan(ctx context.Context, instanceID string) (*dynam
 		return nil, fmt.Errorf("instance metadata has the wrong type %T", i.Parameters)
 	}
 
-	plan, err := decodePlan(params)
-
-	return &plan, err
-}
-
-func (b *Broker) getPlan(ctx context.Context, instanceID string, planID string, planCtx dynamicplans.Context) (dp *dynamicplans.Plan, err error) {
-	dp, err = b.getInstancePlan(ctx, instanceID)
-	if err == nil {
-		return
-	}
-
-	// planCtx == nil means the instance should exist
-	if planCtx == nil {
-		err = errors.Wrapf(err, "cannot find plan for instance %q", instanceID)
-
-		return
-	}
-
-	// new instance: get from plan
-	dp, err = b.parsePlan(planCtx, planID)
+	s, stale, err := b.decodeState(params)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	if dp.Project == nil {
-		err = fmt.Errorf("missing Project in plan definition")
-
-		return
+	if stale {
+		if err := b.upgradeState(ctx, instanceID); err != nil {
+			b.funcLogger().Warnw("Cannot upgrade instance state", "instanceID", instanceID, "error", err)
+		}
 	}
 
-	return
+	return &s, nil
 }
 
-func (b *Broker) getClient(ctx context.Context, instanceID string, planID string, planCtx dynamicplans.Context) (client *mongodbatlas.Client, dp *dynamicplans.Plan, err error) {
-	dp, err = b.getPlan(ctx, instanceID, planID, planCtx)
-	if err != nil {
-		return
-	}
-
+// getPlanClient creates a client for the API key of the plan and merges the
+// existing Atlas project into it.
+func (b *Broker) getPlanClient(ctx context.Context, dp *dynamicplans.Plan) (client *mongodbatlas.Client, err error) {
 	var key credentials.Credential
 
 	switch {
@@ -207,17 +235,8 @@ func (b *Broker) getClient(ctx context.Context, instanceID string, planID string
 		return
 	}
 
-	hc, err := digest.NewTransport(key["publicKey"], key["privateKey"]).Client()
-	if err != nil {
-		err = errors.Wrap(err, "cannot create Digest client")
-
-		return
-	}
-
-	client, err = mongodbatlas.New(hc, mongodbatlas.SetBaseURL(b.cfg.AtlasURL), mongodbatlas.SetUserAgent(b.userAgent))
+	client, err = b.atlasClient(key)
 	if err != nil {
-		err = errors.Wrap(err, "cannot create Atlas client")
-
 		return
 	}
 
@@ -235,13 +254,15 @@ func (b *Broker) getClient(ctx context.Context, instanceID string, planID string
 	return
 }
 
-func (b *Broker) getState(ctx context.Context, orgID string) (*statestorage.RealmStateStorage, error) {
-	key, err := b.credentials.ByOrg(orgID)
+func (b *Broker) atlasClient(key credentials.Credential) (*mongodbatlas.Client, error) {
+	hc, err := digest.NewTransport(key["publicKey"], key["privateKey"]).Client()
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot get API Key by org")
+		return nil, errors.Wrap(err, "cannot create Digest client")
 	}
 
-	return statestorage.Get(ctx, key, b.userAgent, b.cfg.AtlasURL, b.cfg.RealmURL, b.logger)
+	client, err := mongodbatlas.New(hc, mongodbatlas.SetBaseURL(b.cfg.AtlasURL), mongodbatlas.SetUserAgent(b.userAgent))
+
+	return client, errors.Wrap(err, "cannot create Atlas client")
 }
 
 func (b *Broker) AuthMiddleware() mux.MiddlewareFunc {
@@ -261,34 +282,3 @@ func (b *Broker) GetDashboardURL(groupID, clusterName string) string {
 
 	return apiURL.String() + fmt.Sprintf("#clusters/detail/%s", clusterName)
 }
-
-func encodePlan(v dynamicplans.Plan) (string, error) {
-	b := new(bytes.Buffer)
-	b64 := base64.NewEncoder(base64.StdEncoding, b)
-	err := json.NewEncoder(b64).Encode(v)
-	if err != nil {
-		return "", errors.Wrap(err, "cannot marshal plan")
-	}
-
-	err = b64.Close()
-
-	return b.String(), errors.Wrap(err, "cannot finalize base64")
-}
-
-func decodePlan(enc string) (dynamicplans.Plan, error) {
-	b64 := base64.NewDecoder(base64.StdEncoding, strings.NewReader(enc))
-	dp := dynamicplans.Plan{}
-	err := json.NewDecoder(b64).Decode(&dp)
-
-	// try to fix the plan in case of an error
-	if err != nil && dp.APIKey != nil {
-		if dp.Project.OrgID == "" {
-			return dp, fmt.Errorf("failed to fix the plan with error: %w", err)
-		}
-
-		dp.APIKey["orgID"] = dp.Project.OrgID
-		err = nil
-	}
-
-	return dp, errors.Wrap(err, "cannot unmarshal plan")
-}
@@ -15,6 +15,8 @@
 package broker
 
 import (
+	"time"
+
 	"github.com/pivotal-cf/brokerapi/domain"
 )
 
@@ -34,6 +36,9 @@ type catalog struct {
 	services  []domain.Service
 	providers map[string]Provider
 	plans     map[string]domain.ServicePlan
+	// pollingDurations holds the maximum_polling_duration of plans, which
+	// domain.ServicePlan has no field for.
+	pollingDurations map[string]time.Duration
 }
 
 func newCatalog() *catalog {
@@ -41,5 +46,7 @@ func newCatalog() *catalog {
 		services:  []domain.Service{},
 		providers: map[string]Provider{},
 		plans:     map[string]domain.ServicePlan{},
+
+		pollingDurations: map[string]time.Duration{},
 	}
 }
@@ -60,18 +60,9 @@ func FromEnv() ([]*template.Template, error) {
 		// also trim .yml/.yaml/.json (if any)
 		basename = strings.TrimSuffix(basename, filepath.Ext(basename))
 
-		t, err := template.
-			New(basename).
-			Funcs(sprig.TxtFuncMap()).
-			Funcs(template.FuncMap{
-				"default":      dfault,
-				"keyByOrg":     keyByOrg,
-				"keyByAlias":   keyByAlias,
-				"orgIDByAlias": orgIDByAlias,
-			}).
-			Parse(string(text))
+		t, err := NewTemplate(basename, string(text))
 		if err != nil {
-			return nil, errors.Wrap(err, "cannot parse template")
+			return nil, err
 		}
 		templates = append(templates, t)
 	}
@@ -83,6 +74,22 @@ func FromEnv() ([]*template.Template, error) {
 	return templates, nil
 }
 
+// NewTemplate parses text with the functions available to plan templates.
+func NewTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.
+		New(name).
+		Funcs(sprig.TxtFuncMap()).
+		Funcs(template.FuncMap{
+			"default":      dfault,
+			"keyByOrg":     keyByOrg,
+			"keyByAlias":   keyByAlias,
+			"orgIDByAlias": orgIDByAlias,
+		}).
+		Parse(text)
+
+	return t, errors.Wrap(err, "cannot parse template")
+}
+
 // custom default function to fix Sprig's stupidity with booleans
 func dfault(d interface{}, given ...interface{}) interface{} {
 	if empty(given) || empty(given[0]) {
@@ -16,6 +16,8 @@ package dynamicplans
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
 	"github.com/mongodb/atlas-osb/pkg/broker/privateendpoint"
@@ -38,6 +40,15 @@ type Plan struct {
 
 	Settings map[string]interface{} `json:"settings,omitempty"`
 
+	// MaxDuration limits how long each type of operation ("provision",
+	// "update", "deprovision") may take, e.g. "2h".
+	MaxDuration map[string]string `json:"maxDuration,omitempty"`
+
+	// BindingCredentials is a template for the credentials of bindings. It
+	// is rendered at bind time and must produce a YAML or JSON map, whose
+	// values should be quoted with toJson.
+	BindingCredentials string `json:"bindingCredentials,omitempty"`
+
 	// Deprecated: Use IPAccessLists instead!
 	IPWhitelists []*mongodbatlas.ProjectIPWhitelist `json:"ipWhitelists,omitempty"`
 }
@@ -67,6 +78,22 @@ func (p *Plan) SafeCopy() Plan {
 	return safe
 }
 
+// MaxOperationDuration returns the limit for the given type of operation, or
+// 0 if the plan doesn't set one.
+func (p *Plan) MaxOperationDuration(op string) (time.Duration, error) {
+	d, ok := p.MaxDuration[op]
+	if !ok || d == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(d)
+	if err != nil {
+		return 0, fmt.Errorf("invalid maxDuration for %s: %w", op, err)
+	}
+
+	return duration, nil
+}
+
 func (p Plan) String() string {
 	s, err := json.Marshal(p)
 	if err != nil {
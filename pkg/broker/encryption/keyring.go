@@ -0,0 +1,220 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption implements envelope encryption of the instance state.
+// Every value is encrypted with a fresh data key, which is in turn encrypted
+// with one of the broker's master keys. The ID of that master key is stored
+// next to the value, so master keys can be rotated: new values are sealed with
+// the primary key while older ones can still be opened with the others.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sealedPrefix marks sealed values. It can't appear in plain base64, which is
+// how unencrypted state has always been stored.
+const sealedPrefix = "sealed:"
+
+const keySize = 32
+
+// Keyring holds the master keys. The first key is the primary one.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// envelope is the sealed form of a value.
+type envelope struct {
+	KeyID   string `json:"keyId"`
+	DataKey []byte `json:"dataKey"`
+	Data    []byte `json:"data"`
+}
+
+// ParseKeyring parses a comma-separated list of "id:key" pairs, where key is
+// a base64-encoded 256-bit AES key. An empty string yields a nil Keyring,
+// which means state is stored unencrypted.
+func ParseKeyring(s string) (*Keyring, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	k := &Keyring{keys: map[string][]byte{}}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("master key must be in the form id:key")
+		}
+
+		id := parts[0]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate master key ID %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot decode master key %q", id)
+		}
+
+		if len(key) != keySize {
+			return nil, fmt.Errorf("master key %q must be %d bytes long, got %d", id, keySize, len(key))
+		}
+
+		if k.primary == "" {
+			k.primary = id
+		}
+
+		k.keys[id] = key
+	}
+
+	return k, nil
+}
+
+// PrimaryKeyID returns the ID of the key new values are sealed with.
+func (k *Keyring) PrimaryKeyID() string {
+	return k.primary
+}
+
+// IsSealed reports whether the value was produced by Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// KeyID returns the ID of the master key protecting a sealed value.
+func KeyID(value string) (string, error) {
+	e, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	return e.KeyID, nil
+}
+
+// Seal encrypts the value with a new data key protected by the primary key.
+func (k *Keyring) Seal(value string) (string, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", errors.Wrap(err, "cannot generate data key")
+	}
+
+	data, err := encrypt(dataKey, []byte(value))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encrypt value")
+	}
+
+	wrapped, err := encrypt(k.keys[k.primary], dataKey)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encrypt data key")
+	}
+
+	raw, err := json.Marshal(envelope{KeyID: k.primary, DataKey: wrapped, Data: data})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal envelope")
+	}
+
+	return sealedPrefix + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Open decrypts a value produced by Seal with any of the known master keys.
+func (k *Keyring) Open(value string) (string, error) {
+	e, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	masterKey, ok := k.keys[e.KeyID]
+	if !ok {
+		return "", fmt.Errorf("unknown master key %q", e.KeyID)
+	}
+
+	dataKey, err := decrypt(masterKey, e.DataKey)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot decrypt data key")
+	}
+
+	data, err := decrypt(dataKey, e.Data)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot decrypt value")
+	}
+
+	return string(data), nil
+}
+
+func parse(value string) (*envelope, error) {
+	if !IsSealed(value) {
+		return nil, errors.New("value is not sealed")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode envelope")
+	}
+
+	e := &envelope{}
+	if err := json.Unmarshal(raw, e); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal envelope")
+	}
+
+	return e, nil
+}
+
+// encrypt seals plaintext with AES-GCM, prepending the random nonce.
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,69 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), keySize)))
+}
+
+func TestKeyring(t *testing.T) {
+	old, err := ParseKeyring("old:" + testKey('a'))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rotated, err := ParseKeyring("new:" + testKey('b') + ",old:" + testKey('a'))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	t.Run("Seal and Open", func(t *testing.T) {
+		sealed, err := old.Seal("secret")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !IsSealed(sealed) || strings.Contains(sealed, "secret") {
+			t.Fatalf("value is not sealed: %s", sealed)
+		}
+
+		opened, err := old.Open(sealed)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if opened != "secret" {
+			t.Fatalf("unexpected value: %q", opened)
+		}
+	})
+
+	t.Run("Rotated keyring opens old values and seals with the new key", func(t *testing.T) {
+		sealed, _ := old.Seal("secret")
+
+		opened, err := rotated.Open(sealed)
+		if err != nil || opened != "secret" {
+			t.Fatalf("unexpected result: %q %v", opened, err)
+		}
+
+		resealed, _ := rotated.Seal(opened)
+		if id, _ := KeyID(resealed); id != "new" {
+			t.Fatalf("unexpected key ID: %q", id)
+		}
+
+		if _, err := old.Open(resealed); err == nil {
+			t.Fatal("expected an error for an unknown key")
+		}
+	})
+
+	t.Run("Invalid keys are rejected", func(t *testing.T) {
+		for _, s := range []string{"nokey", "short:" + base64.StdEncoding.EncodeToString([]byte("abc")), "a:" + testKey('a') + ",a:" + testKey('b')} {
+			if _, err := ParseKeyring(s); err == nil {
+				t.Fatalf("expected an error for %q", s)
+			}
+		}
+	})
+}
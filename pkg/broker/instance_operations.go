@@ -16,10 +16,13 @@ package broker
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
 	"github.com/mongodb/atlas-osb/pkg/broker/privateendpoint"
@@ -31,21 +34,52 @@ import (
 )
 
 // The different async operations that can be performed.
-// These constants are returned during provisioning, deprovisioning, and
-// updates and are subsequently included in async polls from the platform.
+// These constants, followed by the ID of the operation in the journal, are
+// returned during provisioning, deprovisioning, and updates and are
+// subsequently included in async polls from the platform.
 const (
 	operationProvision   = "provision"
 	operationDeprovision = "deprovision"
 	operationUpdate      = "update"
+	operationBind        = "bind"
 )
 
 // Provision will create a new Atlas cluster with the instance ID as its name.
-// The process is always async.
+// The process is always async. If any step fails, the resources created by the
+// previous steps are removed again.
 func (b Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (spec domain.ProvisionedServiceSpec, err error) {
 	logger := b.funcLogger().With("instance_id", instanceID)
 
 	logger.Infow("Provisioning instance", "details", details)
 
+	// Async needs to be supported for provisioning to work.
+	if !asyncAllowed {
+		err = apiresponses.ErrAsyncRequired
+
+		return
+	}
+
+	fingerprint, err := provisionFingerprint(details)
+	if err != nil {
+		return
+	}
+
+	// a new instance is not in the index, so instead of searching every org
+	// only the one of the plan is checked further down
+	orgID, indexed := b.state.Lookup(instanceID)
+	if indexed {
+		var existing domain.GetInstanceDetailsSpec
+		existing, err = b.getInstanceInOrg(ctx, orgID, instanceID)
+		switch {
+		case err == nil:
+			return b.provisionExisting(existing, details, fingerprint)
+		case errors.Is(err, statestorage.ErrInstanceNotFound):
+			err = nil
+		default:
+			return
+		}
+	}
+
 	planContext := dynamicplans.Context{
 		"instance_id": instanceID,
 	}
@@ -63,11 +97,59 @@ func (b Broker) Provision(ctx context.Context, instanceID string, details domain
 		}
 	}
 
-	client, dp, err := b.getClient(ctx, instanceID, details.PlanID, planContext)
+	dp, err := b.parsePlan(planContext, details.PlanID)
+	if err != nil {
+		return
+	}
+
+	if dp.Project == nil {
+		err = fmt.Errorf("missing Project in plan definition")
+
+		return
+	}
+
+	client, err := b.getPlanClient(ctx, dp)
 	if err != nil {
 		return
 	}
 
+	if !indexed || orgID != dp.Project.OrgID {
+		var existing domain.GetInstanceDetailsSpec
+		existing, err = b.getInstanceInOrg(ctx, dp.Project.OrgID, instanceID)
+		switch {
+		case err == nil:
+			return b.provisionExisting(existing, details, fingerprint)
+		case errors.Is(err, statestorage.ErrInstanceNotFound):
+			err = nil
+		default:
+			return
+		}
+	}
+
+	op := newOperation(operationProvision)
+	sg := &saga{}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		summary, ok := sg.rollback(context.Background())
+		logger.Warnw("Rolled back failed provision", "error", err, "rollback", summary, "complete", ok)
+
+		if summary == "" {
+			return
+		}
+
+		if f, isFailure := err.(*apiresponses.FailureResponse); isFailure {
+			err = f.AppendErrorMessage("(rollback: " + summary + ")")
+		} else {
+			err = fmt.Errorf("%w (rollback: %s)", err, summary)
+		}
+	}()
+
+	defer func() { err = translateAtlasError(err, "provision") }()
+
 	if dp.Project.ID == "" {
 		var newProject *mongodbatlas.Project
 		newProject, _, err = client.Projects.Create(ctx, dp.Project)
@@ -77,8 +159,14 @@ func (b Broker) Provision(ctx context.Context, instanceID string, details domain
 			return
 		}
 
+		sg.onRollback("project "+newProject.Name, func(ctx context.Context) error {
+			return ignoreNotFound(client.Projects.Delete(ctx, newProject.ID))
+		})
+
 		dp.Project = newProject
-		err = b.createOrUpdateResources(ctx, client, dp, dp)
+		op.step(stepProject, domain.Succeeded, "created", nil)
+
+		err = b.createOrUpdateResources(ctx, client, dp, dp, op, sg)
 		if err != nil {
 			logger.Errorw("Cannot update resource", "error", err, "project", dp.Project)
 
@@ -86,20 +174,22 @@ func (b Broker) Provision(ctx context.Context, instanceID string, details domain
 		}
 
 		dp.Project.ID = newProject.ID
-	}
-
-	// Async needs to be supported for provisioning to work.
-	if !asyncAllowed {
-		err = apiresponses.ErrAsyncRequired
-
-		return
+	} else {
+		op.step(stepProject, domain.Succeeded, "already exists", nil)
 	}
 
 	// Construct a cluster definition from the instance ID, service, plan, and params.
 	logger.Infow("Creating cluster", "instance_name", planContext["instance_name"])
 	// TODO - add this context info about k8s/namespace or pcf space into labels
 
-	planEnc, err := encodePlan(*dp)
+	// the state is stored before the cluster is requested, so that it can't be
+	// created without the broker knowing about it
+	op.step(stepCluster, domain.InProgress, "requested", nil)
+	if len(dp.PrivateEndpoints) > 0 {
+		op.step(stepPrivateEndpoints, domain.InProgress, "waiting for cluster", nil)
+	}
+
+	planEnc, err := b.encodeState(instanceState{Plan: *dp, Operation: op, Fingerprint: fingerprint})
 	if err != nil {
 		return
 	}
@@ -116,19 +206,16 @@ func (b Broker) Provision(ctx context.Context, instanceID string, details domain
 		return
 	}
 
-	v, err := state.Put(ctx, instanceID, &s)
+	err = state.Put(ctx, instanceID, &s)
 	if err != nil {
 		logger.Errorw("Error during provision, broker maintenance:", "err", err)
 
 		return
 	}
-	logger.Infow("Inserted new state value", "v", v)
 
-	defer func() {
-		if err != nil {
-			_ = state.DeleteOne(ctx, instanceID)
-		}
-	}()
+	sg.onRollback("state", func(ctx context.Context) error {
+		return state.Delete(ctx, instanceID)
+	})
 
 	// Create a new Atlas cluster from the generated definition
 	resultingCluster, _, err := client.Clusters.Create(ctx, dp.Project.ID, dp.Cluster)
@@ -139,17 +226,54 @@ func (b Broker) Provision(ctx context.Context, instanceID string, details domain
 	}
 
 	logger.Infow("Successfully started Atlas creation process", "cluster", resultingCluster)
+	b.reconciler.enqueue(instanceID)
 
 	return domain.ProvisionedServiceSpec{
 		IsAsync:       true,
-		OperationData: operationProvision,
+		OperationData: op.operationData(),
 		DashboardURL:  b.GetDashboardURL(dp.Project.ID, resultingCluster.Name),
 	}, nil
 }
 
-func (b *Broker) createOrUpdateResources(ctx context.Context, client *mongodbatlas.Client, newPlan *dynamicplans.Plan, oldPlan *dynamicplans.Plan) error {
-	logger := b.funcLogger()
+// createOrUpdateResources brings the project resources in line with newPlan.
+// Resources it creates are registered with sg, which may be nil.
+func (b *Broker) createOrUpdateResources(ctx context.Context, client *mongodbatlas.Client, newPlan *dynamicplans.Plan, oldPlan *dynamicplans.Plan, op *operation, sg *saga) error {
+	if err := b.createOrUpdateUsers(ctx, client, newPlan, oldPlan, sg); err != nil {
+		op.step(stepUsers, domain.Failed, "", err)
+
+		return err
+	}
+
+	op.step(stepUsers, domain.Succeeded, fmt.Sprintf("%d users", len(newPlan.DatabaseUsers)), nil)
+
+	if err := b.createOrUpdateAccessLists(ctx, client, newPlan, oldPlan, sg); err != nil {
+		op.step(stepAccessList, domain.Failed, "", err)
+
+		return err
+	}
 
+	op.step(stepAccessList, domain.Succeeded, fmt.Sprintf("%d entries", len(newPlan.IPAccessLists)), nil)
+
+	for _, i := range newPlan.Integrations {
+		_, _, err := client.Integrations.Replace(ctx, oldPlan.Project.ID, i.Type, i)
+		if err != nil {
+			return errors.Wrap(err, "cannot create Third-Party Integration")
+		}
+
+		integrationType := i.Type
+		sg.onRollback("integration "+integrationType, func(ctx context.Context) error {
+			return ignoreNotFound(client.Integrations.Delete(ctx, oldPlan.Project.ID, integrationType))
+		})
+	}
+
+	if err := b.removeOldPrivateEndpoints(ctx, client, newPlan, oldPlan); err != nil {
+		return errors.Wrap(err, "failed to remove old Private Endpoints")
+	}
+
+	return nil
+}
+
+func (b *Broker) createOrUpdateUsers(ctx context.Context, client *mongodbatlas.Client, newPlan *dynamicplans.Plan, oldPlan *dynamicplans.Plan, sg *saga) error {
 	for _, u := range newPlan.DatabaseUsers {
 		if len(u.Scopes) == 0 {
 			u.Scopes = append(u.Scopes, mongodbatlas.Scope{
@@ -168,9 +292,32 @@ func (b *Broker) createOrUpdateResources(ctx context.Context, client *mongodbatl
 			if err != nil {
 				return errors.Wrap(err, "cannot update Database User")
 			}
+
+			continue
 		}
+
+		dbName, username := planUserAuthDB(u), u.Username
+		sg.onRollback("user "+username, func(ctx context.Context) error {
+			return ignoreNotFound(client.DatabaseUsers.Delete(ctx, dbName, oldPlan.Project.ID, username))
+		})
 	}
 
+	return nil
+}
+
+// planUserAuthDB returns the database a plan user authenticates against.
+// Plans usually leave databaseName empty, which Atlas takes as "admin".
+func planUserAuthDB(u *mongodbatlas.DatabaseUser) string {
+	if u.DatabaseName != "" {
+		return u.DatabaseName
+	}
+
+	return u.GetAuthDB()
+}
+
+func (b *Broker) createOrUpdateAccessLists(ctx context.Context, client *mongodbatlas.Client, newPlan *dynamicplans.Plan, oldPlan *dynamicplans.Plan, sg *saga) error {
+	logger := b.funcLogger()
+
 	// keep support for the deprecated IPWhitelists
 	if len(newPlan.IPWhitelists) > 0 { // nolint
 		// note: Create() is identical to Update()
@@ -186,6 +333,22 @@ func (b *Broker) createOrUpdateResources(ctx context.Context, client *mongodbatl
 		if err != nil {
 			return errors.Wrap(err, "cannot create/update IP Access List")
 		}
+
+		entries := newPlan.IPAccessLists
+		sg.onRollback("access list", func(ctx context.Context) error {
+			for _, e := range entries {
+				entry := e.IPAddress
+				if entry == "" {
+					entry = e.CIDRBlock
+				}
+
+				if err := ignoreNotFound(client.ProjectIPAccessList.Delete(ctx, oldPlan.Project.ID, entry)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
 	}
 
 	// create and populater the set with IPs from the plan
@@ -200,6 +363,11 @@ func (b *Broker) createOrUpdateResources(ctx context.Context, client *mongodbatl
 		return errors.Wrap(err, "cannot get IP Access Lists from Atlas")
 	}
 	for _, item := range atlasAccessLists.Results {
+		// entries of bindings are removed by unbind
+		if isBindingAccessListEntry(item) {
+			continue
+		}
+
 		// delete all IPs which are not in the plan
 		if _, ok := planIPAccessListItems[item.CIDRBlock]; !ok {
 			logger.Debugw("Deleting IP Access List Item", "cidrBlock", item.CIDRBlock, "item", item)
@@ -210,17 +378,6 @@ func (b *Broker) createOrUpdateResources(ctx context.Context, client *mongodbatl
 		}
 	}
 
-	for _, i := range newPlan.Integrations {
-		_, _, err := client.Integrations.Replace(ctx, oldPlan.Project.ID, i.Type, i)
-		if err != nil {
-			return errors.Wrap(err, "cannot create Third-Party Integration")
-		}
-	}
-
-	if err := b.removeOldPrivateEndpoints(ctx, client, newPlan, oldPlan); err != nil {
-		return errors.Wrap(err, "failed to remove old Private Endpoints")
-	}
-
 	return nil
 }
 
@@ -397,11 +554,75 @@ func (b *Broker) postCreateResources(ctx context.Context, client *mongodbatlas.C
 	return
 }
 
+// provisionFingerprint identifies a provision request, so that a repeated
+// request can be told apart from a conflicting one.
+func provisionFingerprint(details domain.ProvisionDetails) (string, error) {
+	var params interface{}
+	if len(details.RawParameters) > 0 {
+		if err := json.Unmarshal(details.RawParameters, &params); err != nil {
+			return "", errors.Wrap(err, "cannot unmarshal parameters")
+		}
+	}
+
+	// marshaling again sorts the keys of the parameters
+	data, err := json.Marshal([]interface{}{details.ServiceID, details.PlanID, params})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// provisionExisting answers a provision request for an instance which already
+// exists: a repeated request gets the last operation of the instance to poll,
+// anything else is a conflict.
+//
+// The OSB spec asks for 200 OK if the instance is already provisioned, which
+// brokerapi v5 cannot send; 202 Accepted with an operation that is reported as
+// succeeded is the closest it gets.
+func (b Broker) provisionExisting(existing domain.GetInstanceDetailsSpec, details domain.ProvisionDetails, fingerprint string) (spec domain.ProvisionedServiceSpec, err error) {
+	enc, ok := existing.Parameters.(string)
+	if !ok {
+		return spec, fmt.Errorf("instance metadata has the wrong type %T", existing.Parameters)
+	}
+
+	s, _, err := b.decodeState(enc)
+	if err != nil {
+		return
+	}
+
+	identical := s.Fingerprint == fingerprint
+	if s.Fingerprint == "" {
+		// instances provisioned before fingerprints were stored
+		identical = existing.PlanID == details.PlanID && existing.ServiceID == details.ServiceID
+	}
+
+	if !identical {
+		return spec, apiresponses.ErrInstanceAlreadyExists
+	}
+
+	spec = domain.ProvisionedServiceSpec{
+		IsAsync:       true,
+		DashboardURL:  existing.DashboardURL,
+		OperationData: operationProvision,
+	}
+
+	if s.Operation != nil {
+		spec.OperationData = s.Operation.operationData()
+	}
+
+	return spec, nil
+}
+
 // Update will change the configuration of an existing Atlas cluster asynchronously.
 func (b Broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (spec domain.UpdateServiceSpec, err error) {
 	logger := b.funcLogger().With("instance_id", instanceID)
 	logger.Infow("Updating instance", "details", details)
 
+	defer func() { err = translateAtlasError(err, "update") }()
+
 	planContext := dynamicplans.Context{
 		"instance_id": instanceID,
 	}
@@ -421,7 +642,19 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 	}
 
 	logger.Infow("Update() planContext merged with details.parameters&context", "planContext", planContext)
-	client, oldPlan, err := b.getClient(ctx, instanceID, details.PlanID, planContext)
+	s, err := b.getInstanceState(ctx, instanceID)
+	if err != nil {
+		if errors.Is(err, statestorage.ErrInstanceNotFound) {
+			err = apiresponses.ErrInstanceDoesNotExist
+		}
+
+		return
+	}
+
+	// the plan is written back at the revision it was read at
+	oldPlan, base := &s.Plan, s.PlanRevision
+
+	client, err := b.getPlanClient(ctx, oldPlan)
 	if err != nil {
 		return
 	}
@@ -433,6 +666,12 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 		return
 	}
 
+	op := newOperation(operationUpdate)
+	if err = b.acquireLease(ctx, oldPlan.Project.OrgID, instanceID, op.ID); err != nil {
+		return
+	}
+	defer b.releaseLease(oldPlan.Project.OrgID, instanceID, op.ID)
+
 	// special case: pause/unpause
 	if paused, ok := planContext["paused"].(bool); ok {
 		logger.Info("Special case: pause/unpause")
@@ -441,10 +680,16 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 		}
 
 		_, _, err = client.Clusters.Update(ctx, oldPlan.Project.ID, oldPlan.Cluster.Name, request)
+		if err == nil {
+			op.step(stepCluster, domain.InProgress, fmt.Sprintf("paused: %v", paused), nil)
+			if errState := b.updateState(ctx, instanceID, details.PlanID, details.ServiceID, oldPlan, base, op); errState != nil {
+				logger.Errorw("Failed when updating the state", "err", errState)
+			}
+		}
 
 		return domain.UpdateServiceSpec{
 			IsAsync:       true,
-			OperationData: operationUpdate,
+			OperationData: op.operationData(),
 			DashboardURL:  b.GetDashboardURL(oldPlan.Project.ID, oldPlan.Cluster.Name),
 		}, errors.Wrap(err, "cannot update Cluster")
 	}
@@ -466,7 +711,7 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 		return
 	}
 
-	err = b.createOrUpdateResources(ctx, client, newPlan, oldPlan)
+	err = b.createOrUpdateResources(ctx, client, newPlan, oldPlan, op, nil)
 	if err != nil {
 		logger.Errorw("Cannot update resources", "error", err)
 
@@ -508,55 +753,52 @@ func (b Broker) Update(ctx context.Context, instanceID string, details domain.Up
 
 	logger.Debugw("Resulting plan to be saved", "plan", oldPlan)
 
-	if err = b.updateState(ctx, instanceID, details.PlanID, details.ServiceID, oldPlan); err != nil {
+	op.step(stepCluster, domain.InProgress, resultingCluster.StateName, nil)
+	if len(oldPlan.PrivateEndpoints) > 0 {
+		op.step(stepPrivateEndpoints, domain.InProgress, "waiting for cluster", nil)
+	}
+
+	if err = b.updateState(ctx, instanceID, details.PlanID, details.ServiceID, oldPlan, base, op); err != nil {
 		logger.Errorw("Failed when updating the state", "err", err)
 	}
 
 	logger.Infow("Successfully started Atlas cluster update process", "cluster", resultingCluster)
+	b.reconciler.enqueue(instanceID)
 
 	return domain.UpdateServiceSpec{
 		IsAsync:       true,
-		OperationData: operationUpdate,
+		OperationData: op.operationData(),
 		DashboardURL:  b.GetDashboardURL(oldPlan.Project.ID, resultingCluster.Name),
 	}, nil
 }
 
-func (b Broker) updateState(ctx context.Context, instanceID string, planID string, serviceID string, p *dynamicplans.Plan) (err error) {
+// updateState stores the plan of the instance, which was read at revision
+// base. The operation journal is replaced with op, unless it is nil.
+func (b Broker) updateState(ctx context.Context, instanceID string, planID string, serviceID string, p *dynamicplans.Plan, base int, op *operation) (err error) {
 	logger := b.funcLogger().With("instance_id", instanceID)
 
-	planEnc, err := encodePlan(*p)
-	if err != nil {
-		return
-	}
-
-	s := domain.GetInstanceDetailsSpec{
-		PlanID:       planID,
-		ServiceID:    serviceID,
-		DashboardURL: b.GetDashboardURL(p.Project.ID, p.Cluster.Name),
-		Parameters:   planEnc,
-	}
-
-	state, err := b.getState(ctx, p.Project.OrgID)
-	if err != nil {
-		return
-	}
+	err = b.modifyInstance(ctx, p.Project.OrgID, instanceID, func(spec *domain.GetInstanceDetailsSpec, s *instanceState) error {
+		spec.PlanID = planID
+		spec.ServiceID = serviceID
+		spec.DashboardURL = b.GetDashboardURL(p.Project.ID, p.Cluster.Name)
 
-	// TODO: make this error-out reversible?
-	err = state.DeleteOne(ctx, instanceID)
-	if err != nil {
-		logger.Errorw("Error delete from state", "err", err)
+		if err := s.replacePlan(base, p); err != nil {
+			return err
+		}
 
-		return
-	}
+		if op != nil {
+			s.Operation = op
+		}
 
-	obj, err := state.Put(ctx, instanceID, &s)
+		return nil
+	})
 	if err != nil {
-		logger.Errorw("Error insert one from state", "err", err, "s", s)
+		logger.Errorw("Error updating state", "err", err)
 
 		return
 	}
 
-	logger.Infow("Inserted into state", "obj", obj)
+	logger.Infow("Updated state", "plan", p.SafeCopy(), "operation", op)
 
 	return
 }
@@ -593,17 +835,41 @@ func (b Broker) Deprovision(ctx context.Context, instanceID string, details doma
 	logger := b.funcLogger().With("instance_id", instanceID)
 	logger.Infow("Deprovisioning instance", "details", details)
 
-	client, p, err := b.getClient(ctx, instanceID, details.PlanID, nil)
+	// Async needs to be supported for provisioning to work.
+	if !asyncAllowed {
+		err = apiresponses.ErrAsyncRequired
+
+		return
+	}
+
+	s, err := b.getInstanceState(ctx, instanceID)
 	if err != nil {
+		if errors.Is(err, statestorage.ErrInstanceNotFound) {
+			err = apiresponses.ErrInstanceDoesNotExist
+		}
+
 		return
 	}
 
-	// Async needs to be supported for provisioning to work.
-	if !asyncAllowed {
-		err = apiresponses.ErrAsyncRequired
+	// a repeated request gets the deprovision which is already running
+	if last := s.Operation; last != nil && last.Type == operationDeprovision && last.State == domain.InProgress {
+		return domain.DeprovisionServiceSpec{
+			IsAsync:       true,
+			OperationData: last.operationData(),
+		}, nil
+	}
 
+	p := &s.Plan
+	client, err := b.getPlanClient(ctx, p)
+	if err != nil {
+		return
+	}
+
+	op := newOperation(operationDeprovision)
+	if err = b.acquireLease(ctx, p.Project.OrgID, instanceID, op.ID); err != nil {
 		return
 	}
+	defer b.releaseLease(p.Project.OrgID, instanceID, op.ID)
 
 	peProvider := "AZURE"
 	peEndpoints, _, err := client.PrivateEndpoints.List(ctx, p.Project.ID, peProvider, nil)
@@ -615,23 +881,43 @@ func (b Broker) Deprovision(ctx context.Context, instanceID string, details doma
 		b.deletePrivateEndpoint(ctx, client, peProvider, peConnection, p)
 	}
 
+	if len(peEndpoints) > 0 {
+		op.step(stepPrivateEndpoints, domain.InProgress, "deleting", nil)
+	}
+
 	_, err = client.Clusters.Delete(ctx, p.Project.ID, p.Cluster.Name)
 	if err != nil {
 		logger.Errorw("Failed to delete Atlas cluster", "error", err)
 	}
 
+	op.step(stepCluster, domain.InProgress, "deleting", nil)
+
+	failedUsers := 0
 	for _, u := range p.DatabaseUsers {
-		_, err = client.DatabaseUsers.Delete(ctx, u.DatabaseName, p.Project.ID, u.Username)
+		_, err = client.DatabaseUsers.Delete(ctx, planUserAuthDB(u), p.Project.ID, u.Username)
 		if err != nil {
 			logger.Errorw("failed to delete Database user", "error", err, "username", u.Username)
+			failedUsers++
 		}
 	}
 
+	op.step(stepUsers, domain.Succeeded, fmt.Sprintf("%d deleted, %d failed", len(p.DatabaseUsers)-failedUsers, failedUsers), nil)
+
+	err = b.modifyInstance(ctx, p.Project.OrgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, s *instanceState) error {
+		s.Operation = op
+
+		return nil
+	})
+	if err != nil {
+		logger.Errorw("Failed to record the operation", "error", err)
+	}
+
 	logger.Infow("Successfully started Atlas Cluster & Project deletion process")
+	b.reconciler.enqueue(instanceID)
 
 	return domain.DeprovisionServiceSpec{
 		IsAsync:       true,
-		OperationData: operationDeprovision,
+		OperationData: op.operationData(),
 	}, nil
 }
 
@@ -648,11 +934,11 @@ func (b Broker) GetInstance(ctx context.Context, instanceID string) (spec domain
 	}
 
 	if enc, ok := spec.Parameters.(string); ok {
-		p, err := decodePlan(enc)
+		s, _, err := b.decodeState(enc)
 		if err != nil {
 			return spec, apiresponses.NewFailureResponse(err, http.StatusInternalServerError, "get-instance")
 		}
-		spec.Parameters = p.SafeCopy()
+		spec.Parameters = s.Plan.SafeCopy()
 	}
 
 	return spec, nil
@@ -661,17 +947,27 @@ func (b Broker) GetInstance(ctx context.Context, instanceID string) (spec domain
 func (b Broker) getInstance(ctx context.Context, instanceID string) (spec domain.GetInstanceDetailsSpec, err error) {
 	logger := b.funcLogger().With("instanceID", instanceID)
 
+	if orgID, ok := b.state.Lookup(instanceID); ok {
+		spec, err = b.getInstanceInOrg(ctx, orgID, instanceID)
+		if err == nil {
+			return
+		}
+
+		// the index might be stale, fall back to searching every org
+		logger.Warnw("Cannot get indexed instance", "orgID", orgID, "error", err)
+	}
+
 	for k, v := range b.credentials.Keys() {
 		logger = logger.With("orgID", k)
 
-		state, err := statestorage.Get(ctx, v, b.userAgent, b.cfg.AtlasURL, b.cfg.RealmURL, b.logger)
+		state, err := b.state.Open(ctx, v)
 		if err != nil {
 			logger.Errorw("Cannot get state storage for org", "error", err)
 
 			continue
 		}
 
-		instance, err := state.FindOne(ctx, instanceID)
+		instance, _, err := state.Get(ctx, instanceID)
 		if err != nil {
 			if !errors.Is(err, statestorage.ErrInstanceNotFound) {
 				logger.Errorw("Cannot find instance in maintenance DB", "error", err)
@@ -683,158 +979,322 @@ func (b Broker) getInstance(ctx context.Context, instanceID string) (spec domain
 		return *instance, nil
 	}
 
-	return domain.GetInstanceDetailsSpec{}, errors.New("cannot find instance in maintenance DB(s): no instances found")
+	return domain.GetInstanceDetailsSpec{}, errors.Wrap(statestorage.ErrInstanceNotFound, "cannot find instance in maintenance DB(s)")
+}
+
+// getInstanceInOrg gets the instance from the state storage of one org.
+func (b Broker) getInstanceInOrg(ctx context.Context, orgID string, instanceID string) (domain.GetInstanceDetailsSpec, error) {
+	state, err := b.getState(ctx, orgID)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, err
+	}
+
+	instance, _, err := state.Get(ctx, instanceID)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, err
+	}
+
+	return *instance, nil
 }
 
-// LastOperation should fetch the state of the provision/deprovision
-// of a cluster.
+// LastOperation reports the state of the provision/deprovision/update of a
+// cluster from the operation journal. The remaining steps are driven by the
+// reconciler.
 func (b Broker) LastOperation(ctx context.Context, instanceID string, details domain.PollDetails) (resp domain.LastOperation, err error) {
 	logger := b.funcLogger().With("instance_id", instanceID)
 	logger.Infow("Fetching state of last operation", "details", details)
 
 	resp.State = domain.Failed
 
-	client, p, err := b.getClient(ctx, instanceID, details.PlanID, nil)
+	// brokerapi will NOT update service state if we return any error, so... we won't?
+	defer func() {
+		if _, ok := err.(*apiresponses.FailureResponse); ok {
+			return
+		}
+
+		if err != nil {
+			resp.State = domain.Failed
+			resp.Description = "got error: " + err.Error()
+			err = nil
+		}
+	}()
+
+	typ, opID := parseOperationData(details.OperationData)
+
+	s, err := b.getInstanceState(ctx, instanceID)
 	if err != nil {
+		// the state is removed once a deprovision has finished, 410 Gone
+		// tells the platform that it succeeded
+		if errors.Is(err, statestorage.ErrInstanceNotFound) {
+			err = apiresponses.ErrInstanceDoesNotExist
+		}
+
 		return
 	}
 
-	cluster, r, err := client.Clusters.Get(ctx, p.Project.ID, p.Cluster.Name)
-	if err != nil {
-		if r.StatusCode != http.StatusNotFound {
-			err = errors.Wrap(err, "cannot get existing cluster")
-			logger.Errorw("Failed to get existing cluster", "error", err)
+	op := s.Operation
 
+	switch {
+	case opID == "" && (op == nil || op.Type != typ):
+		// the operation was started before the journal existed, record it so
+		// that the reconciler picks it up
+		op, err = b.journalOperation(ctx, instanceID, s, typ)
+		if err != nil {
 			return
 		}
-		err = nil
-	}
 
-	logger.Infow("Found existing cluster", "cluster", cluster)
+		b.reconciler.enqueue(instanceID)
+	case opID == "":
+	case op == nil || op.ID != opID:
+		resp.Description = fmt.Sprintf("operation %s is not the last operation of the instance", opID)
 
-	peProvider := "AZURE"
-	peEndpoints, _, err := client.PrivateEndpoints.List(ctx, p.Project.ID, peProvider, nil)
-	if err != nil {
-		logger.Errorw("cannot get Private Endpoints from Atlas", "err", err)
+		return
 	}
 
-	logger.Infow("Found existing Private Endpoints", "endpoints", peEndpoints)
+	if op.State == domain.InProgress {
+		// progress is made by the reconciler, just make sure it's on it
+		b.reconciler.enqueue(instanceID)
+	}
 
-	// brokerapi will NOT update service state if we return any error, so... we won't?
-	defer func() {
-		if err != nil {
-			resp.State = domain.Failed
-			resp.Description = "got error: " + err.Error()
-			err = nil
+	resp.State = op.State
+	resp.Description = op.description()
+
+	return resp, nil
+}
+
+// journalOperation records an operation of type typ, which was started
+// before operations were journaled, as the last operation of the instance.
+func (b Broker) journalOperation(ctx context.Context, instanceID string, s *instanceState, typ string) (*operation, error) {
+	op := newOperation(typ)
+
+	err := b.modifyInstance(ctx, s.Plan.Project.OrgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, stored *instanceState) error {
+		// another poll might have recorded it already
+		if stored.Operation != nil && stored.Operation.Type == typ {
+			op = stored.Operation
+
+			return nil
 		}
-	}()
 
-	switch details.OperationData {
+		stored.Operation = op
+
+		return nil
+	})
+
+	return op, err
+}
+
+// advanceOperation drives op one step further and stores the result, as long
+// as op is still the last operation of the instance.
+func (b Broker) advanceOperation(ctx context.Context, instanceID string, s *instanceState, op *operation) error {
+	logger := b.funcLogger().With("instance_id", instanceID)
+
+	p := &s.Plan
+	client, err := b.getPlanClient(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	before := op.description()
+	deleted, planChanged := false, false
+
+	switch op.Type {
 	case operationProvision, operationUpdate:
-		if r.StatusCode == http.StatusNotFound {
-			resp.State = domain.Failed
-			resp.Description = "cluster not found"
+		planChanged, err = b.driveCreate(ctx, client, p, op)
+	case operationDeprovision:
+		deleted, err = b.driveDelete(ctx, client, instanceID, p, op)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Type)
+	}
 
-			return
+	if err != nil {
+		return err
+	}
+
+	if op.State == domain.InProgress {
+		b.checkDeadline(p, op)
+	}
+
+	if deleted || (!planChanged && op.description() == before) {
+		return nil
+	}
+
+	err = b.modifyInstance(ctx, p.Project.OrgID, instanceID, func(spec *domain.GetInstanceDetailsSpec, stored *instanceState) error {
+		if stored.Operation == nil || stored.Operation.ID != op.ID {
+			return fmt.Errorf("operation %s was superseded", op.ID)
 		}
 
-		retry := false
-		logger.Debugw("Create resources", "plan", p)
-		retry, err = b.postCreateResources(ctx, client, p)
-		if err != nil {
-			logger.Debugw("Create resources error", "error", err, "retry", retry)
+		stored.Operation = op
 
-			break
+		if !planChanged {
+			return nil
 		}
 
-		if retry {
-			resp.State = domain.InProgress
-			resp.Description = "resources are being created"
+		spec.DashboardURL = b.GetDashboardURL(p.Project.ID, p.Cluster.Name)
 
-			if err = b.updateState(ctx, instanceID, details.PlanID, details.ServiceID, p); err != nil {
-				logger.Errorw("Failed when updating the state", "err", err)
-			}
+		return stored.replacePlan(s.PlanRevision, p)
+	})
+	if err != nil {
+		logger.Errorw("Failed when updating the state", "err", err)
 
-			break
+		return err
+	}
+
+	logger.Infow("Updated state", "plan", p.SafeCopy(), "operation", op)
+
+	return nil
+}
+
+// checkDeadline fails the operation if it took longer than the plan allows.
+func (b Broker) checkDeadline(p *dynamicplans.Plan, op *operation) {
+	limit, err := b.maxOperationDuration(p, op.Type)
+	if err != nil {
+		b.funcLogger().Errorw("Cannot get maximum operation duration", "error", err)
+
+		return
+	}
+
+	if limit > 0 && time.Since(op.StartedAt) > limit {
+		op.fail(fmt.Errorf("%s did not finish within %s", op.Type, limit))
+	}
+}
+
+// driveCreate advances a provision or update and records the result in op.
+// planChanged reports whether p was changed and needs to be stored.
+func (b Broker) driveCreate(ctx context.Context, client *mongodbatlas.Client, p *dynamicplans.Plan, op *operation) (planChanged bool, err error) {
+	logger := b.funcLogger()
+
+	cluster, r, err := client.Clusters.Get(ctx, p.Project.ID, p.Cluster.Name)
+	if err != nil {
+		if r == nil || r.StatusCode != http.StatusNotFound {
+			logger.Errorw("Failed to get existing cluster", "error", err)
+
+			return false, errors.Wrap(err, "cannot get existing cluster")
 		}
 
-		switch cluster.StateName {
-		// Provision has succeeded if the cluster is in state "idle".
-		case "IDLE":
-			resp.State = domain.Succeeded
-		case "CREATING", "UPDATING", "REPAIRING":
-			resp.State = domain.InProgress
-			resp.Description = cluster.StateName
-		default:
-			resp.Description = fmt.Sprintf("unknown cluster state %q", cluster.StateName)
+		op.step(stepCluster, domain.Failed, "", errors.New("cluster not found"))
+
+		return false, nil
+	}
+
+	logger.Infow("Found existing cluster", "cluster", cluster)
+
+	logger.Debugw("Create resources", "plan", p)
+	retry, err := b.postCreateResources(ctx, client, p)
+	switch {
+	case err != nil:
+		logger.Debugw("Create resources error", "error", err, "retry", retry)
+		op.step(stepPrivateEndpoints, domain.Failed, "", err)
+	case retry:
+		op.step(stepPrivateEndpoints, domain.InProgress, "resources are being created", nil)
+		planChanged = true
+	case len(p.PrivateEndpoints) > 0:
+		op.step(stepPrivateEndpoints, domain.Succeeded, "", nil)
+	}
+
+	switch cluster.StateName {
+	// Provision has succeeded if the cluster is in state "idle".
+	case "IDLE":
+		op.step(stepCluster, domain.Succeeded, cluster.StateName, nil)
+	case "CREATING", "UPDATING", "REPAIRING":
+		op.step(stepCluster, domain.InProgress, cluster.StateName, nil)
+	default:
+		op.step(stepCluster, domain.Failed, "", fmt.Errorf("unknown cluster state %q", cluster.StateName))
+	}
+
+	return planChanged, nil
+}
+
+// driveDelete advances a deprovision and records the result in op. Once
+// everything is gone the instance state is deleted and deleted is true.
+func (b Broker) driveDelete(ctx context.Context, client *mongodbatlas.Client, instanceID string, p *dynamicplans.Plan, op *operation) (deleted bool, err error) {
+	logger := b.funcLogger().With("instance_id", instanceID)
+
+	cluster, r, err := client.Clusters.Get(ctx, p.Project.ID, p.Cluster.Name)
+	if err != nil {
+		if r == nil || r.StatusCode != http.StatusNotFound {
+			err = errors.Wrap(err, "cannot get existing cluster")
+			logger.Errorw("Failed to get existing cluster", "error", err)
+
+			return
 		}
+		err = nil
+	}
 
-	case operationDeprovision:
-		switch {
-		// The Atlas API may return a 404 response if a cluster is deleted or it
-		// will return the cluster with a state of "DELETED". Both of these
-		// scenarios indicate that a cluster has been successfully deleted.
-		case r.StatusCode == http.StatusNotFound, cluster.StateName == "DELETED":
-			if len(peEndpoints) != 0 {
-				for _, peConnection := range peEndpoints {
-					b.deletePrivateEndpoint(ctx, client, peProvider, peConnection, p)
-				}
+	peProvider := "AZURE"
+	peEndpoints, _, err := client.PrivateEndpoints.List(ctx, p.Project.ID, peProvider, nil)
+	if err != nil {
+		logger.Errorw("cannot get Private Endpoints from Atlas", "err", err)
+		err = nil
+	}
 
-				resp.State = domain.InProgress
+	logger.Infow("Found existing Private Endpoints", "endpoints", peEndpoints)
 
-				break
-			}
+	switch {
+	// The Atlas API may return a 404 response if a cluster is deleted or it
+	// will return the cluster with a state of "DELETED". Both of these
+	// scenarios indicate that a cluster has been successfully deleted.
+	case r.StatusCode == http.StatusNotFound, cluster.StateName == "DELETED":
+		op.step(stepCluster, domain.Succeeded, "deleted", nil)
 
-			if r.StatusCode == http.StatusNotFound || cluster.StateName == "DELETED" {
-				resp.State = domain.Succeeded
+		if len(peEndpoints) != 0 {
+			for _, peConnection := range peEndpoints {
+				b.deletePrivateEndpoint(ctx, client, peProvider, peConnection, p)
 			}
 
-			var r *mongodbatlas.Response
-			r, err = client.Projects.Delete(ctx, p.Project.ID)
-			if err != nil {
-				logger.Errorw(
-					"Cannot delete Atlas Project",
-					"error", err,
-					"projectID", p.Project.ID,
-					"projectName", p.Project.Name,
-				)
+			op.step(stepPrivateEndpoints, domain.InProgress, "deleting", nil)
 
-				if r.StatusCode != http.StatusNotFound {
-					err = errors.Wrap(err, "cannot delete Atlas project")
+			return
+		}
 
-					break
-				}
+		op.step(stepPrivateEndpoints, domain.Succeeded, "deleted", nil)
+
+		var r *mongodbatlas.Response
+		r, err = client.Projects.Delete(ctx, p.Project.ID)
+		if err != nil {
+			logger.Errorw(
+				"Cannot delete Atlas Project",
+				"error", err,
+				"projectID", p.Project.ID,
+				"projectName", p.Project.Name,
+			)
 
-				// don't fail if the project is already deleted
+			if r == nil || r.StatusCode != http.StatusNotFound {
+				op.step(stepProject, domain.Failed, "", err)
 				err = nil
+
+				return
 			}
 
-			state, errDel := b.getState(ctx, p.Project.OrgID)
-			if errDel != nil {
-				logger.Errorw("Failed to get state storage", "error", errDel)
+			// don't fail if the project is already deleted
+			err = nil
+		}
 
-				break
-			}
+		op.step(stepProject, domain.Succeeded, "deleted", nil)
 
-			errDel = state.DeleteOne(ctx, instanceID)
-			if errDel != nil {
-				logger.Errorw("Failed to clean up instance from maintenance store", "error", errDel)
+		state, errDel := b.getState(ctx, p.Project.OrgID)
+		if errDel != nil {
+			logger.Errorw("Failed to get state storage", "error", errDel)
 
-				break
-			}
+			return
+		}
 
-		case cluster.StateName == "DELETING":
-			resp.State = domain.InProgress
+		errDel = state.Delete(ctx, instanceID)
+		if errDel != nil {
+			logger.Errorw("Failed to clean up instance from maintenance store", "error", errDel)
 
-		default:
-			resp.Description = fmt.Sprintf("unknown cluster state %q", cluster.StateName)
+			return
 		}
 
+		deleted = true
+
+	case cluster.StateName == "DELETING":
+		op.step(stepCluster, domain.InProgress, cluster.StateName, nil)
+
 	default:
-		resp.Description = fmt.Sprintf("unknown operation %q", details.OperationData)
+		op.step(stepCluster, domain.Failed, "", fmt.Errorf("unknown cluster state %q", cluster.StateName))
 	}
 
-	return resp, err
+	return
 }
 
 func populateReplicationSpecsIDs(sourceSpec, targetSpec []mongodbatlas.ReplicationSpec) {
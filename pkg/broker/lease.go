@@ -0,0 +1,78 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/statestorage"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+	"github.com/pkg/errors"
+)
+
+// leaseDuration bounds how long a crashed request handler can keep an
+// instance locked.
+const leaseDuration = 5 * time.Minute
+
+var errConcurrentOperation = apiresponses.NewFailureResponseBuilder(
+	errors.New("another operation on this instance is in progress"), http.StatusUnprocessableEntity, "concurrent-operation",
+).WithErrorKey("ConcurrencyError").Build()
+
+// lease marks an instance as being changed by a request handler. It is kept
+// in the instance state, so it is honored by every broker replica.
+type lease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// acquireLease locks the instance for holder. It fails with a 422
+// ConcurrencyError if another handler holds the lease. An asynchronous
+// operation which is still in progress doesn't block it: nothing drives that
+// operation while no one holds the lease, so the new one takes over, e.g. to
+// deprovision an instance whose cluster is stuck being created.
+func (b Broker) acquireLease(ctx context.Context, orgID string, instanceID string, holder string) error {
+	return b.modifyInstance(ctx, orgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, s *instanceState) error {
+		now := time.Now().UTC()
+
+		if s.Lease != nil && s.Lease.Holder != holder && now.Before(s.Lease.ExpiresAt) {
+			return errConcurrentOperation
+		}
+
+		if s.Operation != nil && s.Operation.State == domain.InProgress {
+			b.funcLogger().Debugw("Taking over instance with an operation in progress", "instance_id", instanceID, "operation", s.Operation.ID, "holder", holder)
+		}
+
+		s.Lease = &lease{Holder: holder, ExpiresAt: now.Add(leaseDuration)}
+
+		return nil
+	})
+}
+
+// releaseLease gives up the lease if holder still has it.
+func (b Broker) releaseLease(orgID string, instanceID string, holder string) {
+	err := b.modifyInstance(context.Background(), orgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, s *instanceState) error {
+		if s.Lease != nil && s.Lease.Holder == holder {
+			s.Lease = nil
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, statestorage.ErrInstanceNotFound) {
+		b.funcLogger().Errorw("Cannot release instance lease", "instance_id", instanceID, "error", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+// The steps of asynchronous operations recorded in the journal.
+const (
+	stepProject          = "project"
+	stepUsers            = "users"
+	stepAccessList       = "access list"
+	stepPrivateEndpoints = "private endpoints"
+	stepCluster          = "cluster"
+	stepPropagation      = "propagation"
+)
+
+// operation is the journal of an asynchronous operation. It is stored with the
+// instance state, so LastOperation can report what happened even after the
+// broker was restarted.
+type operation struct {
+	ID        string                    `json:"id"`
+	Type      string                    `json:"type"`
+	StartedAt time.Time                 `json:"startedAt"`
+	State     domain.LastOperationState `json:"state"`
+	Steps     []*operationStep          `json:"steps"`
+	LastError string                    `json:"lastError,omitempty"`
+}
+
+type operationStep struct {
+	Name      string                    `json:"name"`
+	State     domain.LastOperationState `json:"state"`
+	Detail    string                    `json:"detail,omitempty"`
+	Error     string                    `json:"error,omitempty"`
+	UpdatedAt time.Time                 `json:"updatedAt"`
+}
+
+func newOperation(typ string) *operation {
+	return &operation{
+		ID:        randomID(),
+		Type:      typ,
+		StartedAt: time.Now().UTC(),
+		State:     domain.InProgress,
+	}
+}
+
+// operationData is what the broker returns to the platform as OperationData
+// and gets back in LastOperation.
+func (o *operation) operationData() string {
+	return o.Type + ":" + o.ID
+}
+
+// parseOperationData splits OperationData into the operation type and ID.
+// Operations started before the journal existed only carry the type.
+func parseOperationData(data string) (typ string, id string) {
+	parts := strings.SplitN(data, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// step records the state of a step. A non-nil err marks it as failed.
+func (o *operation) step(name string, state domain.LastOperationState, detail string, err error) {
+	var s *operationStep
+	for _, existing := range o.Steps {
+		if existing.Name == name {
+			s = existing
+
+			break
+		}
+	}
+
+	if s == nil {
+		s = &operationStep{Name: name}
+		o.Steps = append(o.Steps, s)
+	}
+
+	s.State, s.Detail, s.Error = state, detail, ""
+	s.UpdatedAt = time.Now().UTC()
+
+	if err != nil {
+		s.State = domain.Failed
+		s.Error = err.Error()
+		o.LastError = fmt.Sprintf("%s: %s", name, err)
+	}
+
+	o.State = o.overallState()
+}
+
+// fail marks the whole operation as failed, e.g. because it was abandoned.
+func (o *operation) fail(err error) {
+	o.State = domain.Failed
+	o.LastError = err.Error()
+}
+
+func (o *operation) overallState() domain.LastOperationState {
+	state := domain.Succeeded
+
+	for _, s := range o.Steps {
+		switch s.State {
+		case domain.Failed:
+			return domain.Failed
+		case domain.InProgress:
+			state = domain.InProgress
+		}
+	}
+
+	return state
+}
+
+// description summarizes the journal for LastOperation.
+func (o *operation) description() string {
+	steps := make([]string, 0, len(o.Steps))
+	for _, s := range o.Steps {
+		step := fmt.Sprintf("%s %s", s.Name, s.State)
+		if s.Detail != "" {
+			step += fmt.Sprintf(" (%s)", s.Detail)
+		}
+
+		steps = append(steps, step)
+	}
+
+	d := fmt.Sprintf("%s started at %s", o.Type, o.StartedAt.Format(time.RFC3339))
+	if len(steps) > 0 {
+		d += ": " + strings.Join(steps, ", ")
+	}
+
+	if o.LastError != "" {
+		d += "; last error: " + o.LastError
+	}
+
+	return d
+}
+
+func randomID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
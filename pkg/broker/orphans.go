@@ -0,0 +1,344 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pkg/errors"
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+// The label the sample plans put on every cluster the broker creates. Projects
+// containing such a cluster are considered to be managed by the broker.
+const (
+	brokerLabelKey   = "Infrastructure Tool"
+	brokerLabelValue = "MongoDB Atlas Service Broker"
+)
+
+// OrphanReport lists the differences between the broker state and Atlas.
+type OrphanReport struct {
+	// Instances have a state record, but their project or cluster is gone.
+	Instances []OrphanedInstance `json:"instances"`
+	// Projects contain broker-managed clusters, but no instance refers to them.
+	Projects []OrphanedProject `json:"projects"`
+	// Errors prevented parts of the organizations from being checked.
+	Errors []string `json:"errors,omitempty"`
+}
+
+type OrphanedInstance struct {
+	OrgID       string `json:"orgId"`
+	InstanceID  string `json:"instanceId"`
+	ProjectID   string `json:"projectId"`
+	ClusterName string `json:"clusterName"`
+	Reason      string `json:"reason"`
+	CleanedUp   bool   `json:"cleanedUp,omitempty"`
+}
+
+type OrphanedProject struct {
+	OrgID       string   `json:"orgId"`
+	ProjectID   string   `json:"projectId"`
+	ProjectName string   `json:"projectName"`
+	Clusters    []string `json:"clusters"`
+	// UnmanagedClusters don't carry the broker label. They are never deleted
+	// and keep the project from being deleted.
+	UnmanagedClusters []string `json:"unmanagedClusters,omitempty"`
+	CleanedUp         bool     `json:"cleanedUp,omitempty"`
+}
+
+// OrphanCleanup selects which side FindOrphans cleans up.
+type OrphanCleanup struct {
+	// Instances removes the state records of orphaned instances.
+	Instances bool
+	// Projects deletes the broker-managed clusters of orphaned projects, and
+	// the project itself once they are gone and no other clusters are left.
+	Projects bool
+}
+
+// FindOrphans compares the state of every organization with its Atlas
+// projects and optionally cleans up the orphans it finds.
+func (b *Broker) FindOrphans(ctx context.Context, cleanup OrphanCleanup) *OrphanReport {
+	report := &OrphanReport{
+		Instances: []OrphanedInstance{},
+		Projects:  []OrphanedProject{},
+	}
+
+	for orgID, key := range b.credentials.Keys() {
+		if err := b.findOrgOrphans(ctx, orgID, key, cleanup, report); err != nil {
+			b.funcLogger().Errorw("Cannot check organization for orphans", "orgID", orgID, "error", err)
+			report.Errors = append(report.Errors, fmt.Sprintf("org %s: %v", orgID, err))
+		}
+	}
+
+	return report
+}
+
+func (b *Broker) findOrgOrphans(ctx context.Context, orgID string, key credentials.Credential, cleanup OrphanCleanup, report *OrphanReport) error {
+	logger := b.funcLogger().With("orgID", orgID)
+
+	client, err := b.atlasClient(key)
+	if err != nil {
+		return err
+	}
+
+	state, err := b.state.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	ids, err := state.List(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot list instances")
+	}
+
+	knownProjects := map[string]bool{}
+
+	// Projects can only be cleaned up if every instance could be read: an
+	// unreadable record might be the one using the project.
+	complete := true
+
+	for _, id := range ids {
+		v, _, err := state.Get(ctx, id)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("instance %s: %v", id, err))
+			complete = false
+
+			continue
+		}
+
+		enc, _ := v.Parameters.(string)
+		s, _, err := b.decodeState(enc)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("instance %s: %v", id, err))
+			complete = false
+
+			continue
+		}
+
+		p := s.Plan
+		if p.Project == nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("instance %s: plan has no project", id))
+			complete = false
+
+			continue
+		}
+
+		knownProjects[p.Project.ID] = true
+
+		clusterName := ""
+		if p.Cluster != nil {
+			clusterName = p.Cluster.Name
+		}
+
+		reason := ""
+		_, r, err := client.Projects.GetOneProject(ctx, p.Project.ID)
+		switch {
+		case r != nil && r.StatusCode == http.StatusNotFound:
+			reason = "project not found"
+		case err != nil:
+			report.Errors = append(report.Errors, fmt.Sprintf("instance %s: cannot get project: %v", id, err))
+
+			continue
+		case clusterName == "":
+			// nothing else to check for instances without a cluster
+		default:
+			_, r, err = client.Clusters.Get(ctx, p.Project.ID, clusterName)
+			switch {
+			case r != nil && r.StatusCode == http.StatusNotFound:
+				reason = "cluster not found"
+			case err != nil:
+				report.Errors = append(report.Errors, fmt.Sprintf("instance %s: cannot get cluster: %v", id, err))
+
+				continue
+			}
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		o := OrphanedInstance{
+			OrgID:       orgID,
+			InstanceID:  id,
+			ProjectID:   p.Project.ID,
+			ClusterName: clusterName,
+			Reason:      reason,
+		}
+
+		if cleanup.Instances {
+			err := state.Delete(ctx, id)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("instance %s: cannot delete state: %v", id, err))
+			}
+
+			o.CleanedUp = err == nil
+			logger.Infow("Removed state of orphaned instance", "instance", o, "error", err)
+		}
+
+		report.Instances = append(report.Instances, o)
+	}
+
+	projects, err := b.listProjects(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	cleanProjects := cleanup.Projects
+	if cleanProjects && !complete {
+		report.Errors = append(report.Errors, fmt.Sprintf("org %s: not cleaning up projects, some instances could not be read", orgID))
+		cleanProjects = false
+	}
+
+	for _, project := range projects {
+		if project.OrgID != orgID || knownProjects[project.ID] {
+			continue
+		}
+
+		clusters, _, err := client.Clusters.List(ctx, project.ID, nil)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("project %s: cannot list clusters: %v", project.ID, err))
+
+			continue
+		}
+
+		managed := []mongodbatlas.Cluster{}
+		o := OrphanedProject{
+			OrgID:       orgID,
+			ProjectID:   project.ID,
+			ProjectName: project.Name,
+			Clusters:    []string{},
+		}
+
+		for _, c := range clusters {
+			if hasBrokerLabel(c) {
+				managed = append(managed, c)
+				o.Clusters = append(o.Clusters, c.Name)
+			} else {
+				o.UnmanagedClusters = append(o.UnmanagedClusters, c.Name)
+			}
+		}
+
+		if len(managed) == 0 {
+			continue
+		}
+
+		if cleanProjects {
+			o.CleanedUp = b.deleteOrphanedProject(ctx, client, project.ID, managed, len(o.UnmanagedClusters) == 0, report)
+			logger.Infow("Cleaned up orphaned project", "project", o)
+		}
+
+		report.Projects = append(report.Projects, o)
+	}
+
+	return nil
+}
+
+// deleteOrphanedProject deletes the broker-managed clusters of the project and
+// then the project itself, unless it has other clusters. Atlas refuses to
+// delete projects with clusters which are still terminating, so this can take
+// several runs to complete.
+func (b *Broker) deleteOrphanedProject(ctx context.Context, client *mongodbatlas.Client, projectID string, managed []mongodbatlas.Cluster, onlyManaged bool, report *OrphanReport) bool {
+	for _, c := range managed {
+		if c.StateName == "DELETING" {
+			continue
+		}
+
+		if _, err := client.Clusters.Delete(ctx, projectID, c.Name); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("project %s: cannot delete cluster %s: %v", projectID, c.Name, err))
+		}
+	}
+
+	if !onlyManaged {
+		report.Errors = append(report.Errors, fmt.Sprintf("project %s: not deleted, it has clusters which are not managed by the broker", projectID))
+
+		return false
+	}
+
+	if _, err := client.Projects.Delete(ctx, projectID); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("project %s: cannot delete project (yet): %v", projectID, err))
+
+		return false
+	}
+
+	return true
+}
+
+func (b *Broker) listProjects(ctx context.Context, client *mongodbatlas.Client) ([]*mongodbatlas.Project, error) {
+	const pageSize = 100
+
+	result := []*mongodbatlas.Project{}
+	for page := 1; ; page++ {
+		projects, _, err := client.Projects.GetAllProjects(ctx, &mongodbatlas.ListOptions{PageNum: page, ItemsPerPage: pageSize})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot list projects")
+		}
+
+		result = append(result, projects.Results...)
+
+		if len(projects.Results) < pageSize || len(result) >= projects.TotalCount {
+			return result, nil
+		}
+	}
+}
+
+func hasBrokerLabel(c mongodbatlas.Cluster) bool {
+	for _, l := range c.Labels {
+		if l.Key == brokerLabelKey && l.Value == brokerLabelValue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OrphansHandler serves the orphan report. POST requests clean up the sides
+// selected with the "cleanup" query parameter ("instances", "projects").
+func (b *Broker) OrphansHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cleanup := OrphanCleanup{}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			for _, c := range r.URL.Query()["cleanup"] {
+				switch c {
+				case "instances":
+					cleanup.Instances = true
+				case "projects":
+					cleanup.Projects = true
+				default:
+					http.Error(w, fmt.Sprintf("unknown cleanup target %q", c), http.StatusBadRequest)
+
+					return
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		report := b.FindOrphans(r.Context(), cleanup)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			b.funcLogger().Errorw("Cannot write orphan report", "error", err)
+		}
+	})
+}
@@ -0,0 +1,367 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/statestorage"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+)
+
+// fullScanInterval is how often the reconciler reads the state of every
+// instance, to pick up operations and temporary bindings it wasn't told about,
+// e.g. those of a broker replica which went away.
+const fullScanInterval = time.Hour
+
+// reconciler drives the asynchronous operations of all instances in the
+// background, so they make progress whether the platform polls or not. It also
+// sweeps bindings which have expired.
+// Instances are tracked while they are in flight, i.e. have an operation in
+// progress or temporary bindings, and queued every interval. Handlers track
+// the instances they start operations on with enqueue. Only the full scans,
+// at startup and then every fullScanInterval, read every instance.
+type reconciler struct {
+	b        *Broker
+	workers  int
+	interval time.Duration
+	queue    chan string
+
+	mu       sync.Mutex
+	pending  map[string]bool
+	tracked  map[string]bool
+	lastFull time.Time
+}
+
+func newReconciler(b *Broker, workers int, interval time.Duration) *reconciler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &reconciler{
+		b:        b,
+		workers:  workers,
+		interval: interval,
+		queue:    make(chan string, workers),
+		pending:  map[string]bool{},
+		tracked:  map[string]bool{},
+	}
+}
+
+// Run starts the workers and scans the tracked instances until ctx is done.
+func (r *reconciler) Run(ctx context.Context) {
+	for i := 0; i < r.workers; i++ {
+		go r.work(ctx)
+	}
+
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		r.scan(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// track remembers the instance as in flight without queuing it right away.
+func (r *reconciler) track(instanceID string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tracked[instanceID] = true
+}
+
+// forget stops tracking the instance once it is no longer in flight.
+func (r *reconciler) forget(instanceID string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.tracked, instanceID)
+}
+
+// enqueue tracks the instance and schedules it unless it is already waiting
+// or being reconciled. It never blocks: if all workers are busy, the instance
+// is picked up by the next scan.
+func (r *reconciler) enqueue(instanceID string) {
+	if r == nil {
+		return
+	}
+
+	r.track(instanceID)
+
+	if !r.markPending(instanceID) {
+		return
+	}
+
+	select {
+	case r.queue <- instanceID:
+	default:
+		r.done(instanceID)
+	}
+}
+
+func (r *reconciler) markPending(instanceID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending[instanceID] {
+		return false
+	}
+	r.pending[instanceID] = true
+
+	return true
+}
+
+func (r *reconciler) done(instanceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, instanceID)
+}
+
+func (r *reconciler) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-r.queue:
+			if err := r.b.reconcile(ctx, id); err != nil {
+				r.b.logger.Errorw("Cannot reconcile instance", "instance_id", id, "error", err)
+			}
+
+			r.done(id)
+		}
+	}
+}
+
+// scan queues the tracked instances, waiting for the workers to take them
+// until ctx is done.
+func (r *reconciler) scan(ctx context.Context) {
+	if time.Since(r.lastFull) >= fullScanInterval {
+		r.fullScan(ctx)
+		r.lastFull = time.Now()
+	}
+
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.tracked))
+	for id := range r.tracked {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		if !r.markPending(id) {
+			continue
+		}
+
+		select {
+		case r.queue <- id:
+		case <-ctx.Done():
+			r.done(id)
+
+			return
+		}
+	}
+}
+
+// fullScan tracks every instance which is in flight.
+func (r *reconciler) fullScan(ctx context.Context) {
+	logger := r.b.funcLogger()
+
+	for orgID, key := range r.b.credentials.Keys() {
+		state, err := r.b.state.Open(ctx, key)
+		if err != nil {
+			logger.Errorw("Cannot open state storage", "orgID", orgID, "error", err)
+
+			continue
+		}
+
+		ids, err := state.List(ctx)
+		if err != nil {
+			logger.Errorw("Cannot list instances", "orgID", orgID, "error", err)
+
+			continue
+		}
+
+		for _, id := range ids {
+			spec, _, err := state.Get(ctx, id)
+			if err != nil {
+				logger.Errorw("Cannot get instance", "orgID", orgID, "instance_id", id, "error", err)
+
+				continue
+			}
+
+			enc, _ := spec.Parameters.(string)
+			s, _, err := r.b.decodeState(enc)
+			if err != nil {
+				logger.Errorw("Cannot decode instance state", "orgID", orgID, "instance_id", id, "error", err)
+
+				continue
+			}
+
+			if s.inFlight() {
+				r.track(id)
+			}
+		}
+	}
+}
+
+// reconcile advances the operation in progress of the instance, if any, and
+// sweeps its expired bindings. The instance is leased meanwhile, so that other
+// broker replicas don't drive the same operation.
+func (b *Broker) reconcile(ctx context.Context, instanceID string) error {
+	s, err := b.getInstanceState(ctx, instanceID)
+	if errors.Is(err, statestorage.ErrInstanceNotFound) {
+		b.reconciler.forget(instanceID)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !s.inFlight() {
+		b.reconciler.forget(instanceID)
+
+		return nil
+	}
+
+	if !s.needsReconcile(time.Now()) {
+		return nil
+	}
+
+	orgID := s.Plan.Project.OrgID
+	holder := "reconciler:" + randomID()
+
+	err = b.acquireLease(ctx, orgID, instanceID, holder)
+	if err == errConcurrentOperation {
+		b.funcLogger().Debugw("Instance is leased, skipping", "instance_id", instanceID)
+
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer b.releaseLease(orgID, instanceID, holder)
+
+	// the instance might have changed before it was leased
+	s, err = b.getInstanceState(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+
+	if err := b.sweepBindings(ctx, instanceID, s); err != nil {
+		b.funcLogger().Errorw("Cannot sweep expired bindings", "instance_id", instanceID, "error", err)
+	}
+
+	op := s.Operation
+	if op == nil || op.State != domain.InProgress {
+		return nil
+	}
+
+	if err := b.advanceOperation(ctx, instanceID, s, op); err != nil {
+		return err
+	}
+
+	if !s.inFlight() {
+		b.reconciler.forget(instanceID)
+	}
+
+	return nil
+}
+
+// inFlight reports whether the instance needs the reconciler now or later.
+func (s *instanceState) inFlight() bool {
+	if s.Operation != nil && s.Operation.State == domain.InProgress {
+		return true
+	}
+
+	for _, bd := range s.Bindings {
+		if bd.ExpiresAt != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *instanceState) needsReconcile(now time.Time) bool {
+	return (s.Operation != nil && s.Operation.State == domain.InProgress) || s.hasExpiredBindings(now)
+}
+
+func (s *instanceState) hasExpiredBindings(now time.Time) bool {
+	for _, bd := range s.Bindings {
+		if bd.expired(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sweepBindings forgets the bindings whose users Atlas has deleted because
+// they expired, and removes their access list entries.
+func (b *Broker) sweepBindings(ctx context.Context, instanceID string, s *instanceState) error {
+	now := time.Now()
+	if !s.hasExpiredBindings(now) {
+		return nil
+	}
+
+	p := s.Plan
+	client, err := b.getPlanClient(ctx, &p)
+	if err != nil {
+		return err
+	}
+
+	inUse := s.bindingAccessList(now, "")
+	for _, bd := range s.Bindings {
+		if !bd.expired(now) || len(bd.AccessList) == 0 {
+			continue
+		}
+
+		if err := deleteBindingAccessList(ctx, client, p.Project.ID, bd.AccessList, inUse); err != nil {
+			return err
+		}
+	}
+
+	return b.modifyInstance(ctx, p.Project.OrgID, instanceID, func(_ *domain.GetInstanceDetailsSpec, stored *instanceState) error {
+		for id, bd := range stored.Bindings {
+			if bd.expired(now) {
+				b.funcLogger().Infow("Forgetting expired binding", "instance_id", instanceID, "binding_id", id)
+				delete(stored.Bindings, id)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/atlas/mongodbatlas"
+)
+
+// saga collects the undo actions of the steps of an operation, so that a
+// failed operation can be rolled back. A nil saga ignores everything, which
+// lets shared code register undo actions unconditionally.
+type saga struct {
+	undo []compensation
+}
+
+type compensation struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// onRollback registers the undo action of a completed step.
+func (s *saga) onRollback(name string, fn func(ctx context.Context) error) {
+	if s == nil {
+		return
+	}
+
+	s.undo = append(s.undo, compensation{name: name, fn: fn})
+}
+
+// rollback runs the undo actions in reverse order and describes the outcome
+// of each of them. Failed undo actions don't stop the rollback.
+func (s *saga) rollback(ctx context.Context) (summary string, ok bool) {
+	ok = true
+	results := make([]string, 0, len(s.undo))
+
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		c := s.undo[i]
+
+		if err := c.fn(ctx); err != nil {
+			ok = false
+			results = append(results, fmt.Sprintf("%s: %v", c.name, err))
+
+			continue
+		}
+
+		results = append(results, c.name+": undone")
+	}
+
+	return strings.Join(results, ", "), ok
+}
+
+// ignoreNotFound treats an Atlas resource which is already gone as deleted.
+func ignoreNotFound(r *mongodbatlas.Response, err error) error {
+	if r != nil && r.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
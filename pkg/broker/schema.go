@@ -0,0 +1,212 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
+	"github.com/pkg/errors"
+)
+
+// instanceState is everything the broker keeps about an instance.
+type instanceState struct {
+	Plan dynamicplans.Plan
+	// PlanRevision counts the changes of Plan, so that a handler can tell
+	// whether someone else changed it since it was read.
+	PlanRevision int
+	// Operation is the journal of the last asynchronous operation.
+	Operation *operation
+	// Lease is held by the request handler currently changing the instance.
+	Lease *lease
+	// Fingerprint identifies the provision request of the instance.
+	Fingerprint string
+	// Bindings are the stored bindings by ID.
+	Bindings map[string]*binding
+}
+
+// stateRecord is the stored form of an instanceState. Records written before
+// the schema was versioned are a bare plan and are treated as version 0.
+type stateRecord struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	Plan          json.RawMessage     `json:"plan"`
+	PlanRevision  int                 `json:"planRevision,omitempty"`
+	Operation     *operation          `json:"operation,omitempty"`
+	Lease         *lease              `json:"lease,omitempty"`
+	Fingerprint   string              `json:"fingerprint,omitempty"`
+	Bindings      map[string]*binding `json:"bindings,omitempty"`
+}
+
+// migration upgrades the raw JSON of a plan by one schema version.
+type migration struct {
+	description string
+	migrate     func(plan map[string]interface{}) error
+}
+
+// migrations are applied in order: migrations[i] upgrades a plan from schema
+// version i to i+1. New migrations must only ever be appended.
+var migrations = []migration{
+	{"flatten apiKey and take orgID from the project", migrateFlattenAPIKey},
+}
+
+// currentSchemaVersion is the version encodeRecord writes.
+var currentSchemaVersion = len(migrations)
+
+func encodePlan(v dynamicplans.Plan) (string, error) {
+	return encodeRecord(instanceState{Plan: v})
+}
+
+func encodeRecord(s instanceState) (string, error) {
+	plan, err := json.Marshal(s.Plan)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal plan")
+	}
+
+	b := new(bytes.Buffer)
+	b64 := base64.NewEncoder(base64.StdEncoding, b)
+	err = json.NewEncoder(b64).Encode(stateRecord{
+		SchemaVersion: currentSchemaVersion,
+		Plan:          plan,
+		PlanRevision:  s.PlanRevision,
+		Operation:     s.Operation,
+		Lease:         s.Lease,
+		Fingerprint:   s.Fingerprint,
+		Bindings:      s.Bindings,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal state record")
+	}
+
+	err = b64.Close()
+
+	return b.String(), errors.Wrap(err, "cannot finalize base64")
+}
+
+func decodePlan(enc string) (dynamicplans.Plan, error) {
+	s, _, err := decodeRecord(enc)
+
+	return s.Plan, err
+}
+
+// decodeRecord decodes a value written by encodeRecord, migrating it to the
+// current schema if necessary. version is the schema version the record was
+// stored with.
+func decodeRecord(enc string) (s instanceState, version int, err error) {
+	b64 := base64.NewDecoder(base64.StdEncoding, strings.NewReader(enc))
+
+	raw := map[string]json.RawMessage{}
+	if err = json.NewDecoder(b64).Decode(&raw); err != nil {
+		err = errors.Wrap(err, "cannot unmarshal state record")
+
+		return
+	}
+
+	planJSON := json.RawMessage{}
+	if _, ok := raw["schemaVersion"]; ok {
+		r := stateRecord{}
+		if err = remarshal(raw, &r); err != nil {
+			return
+		}
+
+		version, planJSON = r.SchemaVersion, r.Plan
+		s.PlanRevision = r.PlanRevision
+		s.Operation, s.Lease, s.Fingerprint, s.Bindings = r.Operation, r.Lease, r.Fingerprint, r.Bindings
+	} else {
+		planJSON, err = json.Marshal(raw)
+		if err != nil {
+			return
+		}
+	}
+
+	if version > currentSchemaVersion {
+		err = fmt.Errorf("state record has schema version %d, but this broker only supports up to %d", version, currentSchemaVersion)
+
+		return
+	}
+
+	if version < currentSchemaVersion {
+		planJSON, err = migrate(planJSON, version)
+		if err != nil {
+			return
+		}
+	}
+
+	err = errors.Wrap(json.Unmarshal(planJSON, &s.Plan), "cannot unmarshal plan")
+
+	return
+}
+
+func migrate(planJSON json.RawMessage, from int) (json.RawMessage, error) {
+	plan := map[string]interface{}{}
+	if err := json.Unmarshal(planJSON, &plan); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal plan for migration")
+	}
+
+	for v := from; v < currentSchemaVersion; v++ {
+		if err := migrations[v].migrate(plan); err != nil {
+			return nil, errors.Wrapf(err, "migration from schema version %d (%s) failed", v, migrations[v].description)
+		}
+	}
+
+	return json.Marshal(plan)
+}
+
+func remarshal(in interface{}, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+// migrateFlattenAPIKey fixes plans stored when apiKey was the full Atlas API
+// key object, with the organization nested in roles: only string fields are
+// kept and orgID is taken from the project. Keys which are already flat are
+// left as they are if the project has no orgId either.
+func migrateFlattenAPIKey(plan map[string]interface{}) error {
+	apiKey, ok := plan["apiKey"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	flat := true
+	for k, v := range apiKey {
+		if _, ok := v.(string); !ok {
+			delete(apiKey, k)
+			flat = false
+		}
+	}
+
+	if apiKey["orgID"] != nil {
+		return nil
+	}
+
+	project, _ := plan["project"].(map[string]interface{})
+	orgID, _ := project["orgId"].(string)
+
+	switch {
+	case orgID != "":
+		apiKey["orgID"] = orgID
+	case !flat:
+		return errors.New("cannot determine apiKey.orgID: project.orgId is empty")
+	}
+
+	return nil
+}
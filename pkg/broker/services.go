@@ -17,10 +17,14 @@ package broker
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/gorilla/mux"
 	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
 	"github.com/pivotal-cf/brokerapi/domain"
 )
@@ -59,7 +63,7 @@ func (b *Broker) buildServiceTemplate() (service domain.Service) {
 		Tags:                 strings.Split(b.cfg.ServiceTags, ","),
 		Bindable:             true,
 		InstancesRetrievable: true,
-		BindingsRetrievable:  false,
+		BindingsRetrievable:  true,
 		Metadata: &domain.ServiceMetadata{
 			DisplayName:         fmt.Sprintf("MongoDB Atlas - %s", b.cfg.ServiceDisplayName),
 			ImageUrl:            b.cfg.ImageURL,
@@ -127,6 +131,13 @@ func (b *Broker) buildPlansForProviderDynamic() []domain.ServicePlan {
 			}
 		}
 
+		pollingDuration, err := b.maxPollingDuration(&p)
+		if err != nil {
+			logger.Errorw("invalid yaml template", "name", template.Name(), "error", err)
+
+			continue
+		}
+
 		plan := domain.ServicePlan{
 			ID:          planIDForDynamicPlan("template", p.Name),
 			Name:        p.Name,
@@ -143,12 +154,118 @@ func (b *Broker) buildPlansForProviderDynamic() []domain.ServicePlan {
 		}
 		plans = append(plans, plan)
 
+		if pollingDuration > 0 {
+			b.catalog.pollingDurations[plan.ID] = pollingDuration
+		}
+
 		continue
 	}
 
 	return plans
 }
 
+// maxPollingDuration is the longest any operation of the plan may take.
+func (b *Broker) maxPollingDuration(p *dynamicplans.Plan) (time.Duration, error) {
+	longest := time.Duration(0)
+
+	for _, op := range []string{operationProvision, operationUpdate, operationDeprovision} {
+		d, err := b.maxOperationDuration(p, op)
+		if err != nil {
+			return 0, err
+		}
+
+		if d > longest {
+			longest = d
+		}
+	}
+
+	return longest, nil
+}
+
+// maxOperationDuration returns the limit the plan sets for the operation,
+// falling back to the global default. 0 means there is no limit.
+func (b *Broker) maxOperationDuration(p *dynamicplans.Plan, op string) (time.Duration, error) {
+	d, err := p.MaxOperationDuration(op)
+	if err != nil || d > 0 {
+		return d, err
+	}
+
+	return b.cfg.MaxOperationDuration, nil
+}
+
+// CatalogExtensions adds the fields brokerapi doesn't know about to the
+// catalog response.
+func (b *Broker) CatalogExtensions() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != "/v2/catalog" || len(b.catalog.pollingDurations) == 0 {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			rec := &responseRecorder{header: w.Header(), status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			body := rec.body.Bytes()
+			if rec.status == http.StatusOK {
+				if patched, err := b.addPollingDurations(body); err == nil {
+					body = patched
+				} else {
+					b.funcLogger().Errorw("Cannot add maximum_polling_duration to catalog", "error", err)
+				}
+			}
+
+			w.Header().Del("Content-Length")
+			w.WriteHeader(rec.status)
+			_, _ = w.Write(body)
+		})
+	}
+}
+
+func (b *Broker) addPollingDurations(body []byte) ([]byte, error) {
+	resp := map[string][]map[string]interface{}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	for _, svc := range resp["services"] {
+		plans, _ := svc["plans"].([]interface{})
+		for _, p := range plans {
+			plan, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			id, _ := plan["id"].(string)
+			if d, ok := b.catalog.pollingDurations[id]; ok {
+				plan["maximum_polling_duration"] = int(d.Seconds())
+			}
+		}
+	}
+
+	return json.Marshal(resp)
+}
+
+// responseRecorder buffers a response so it can be changed before sending.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
 // serviceIDForProvider will generate a globally unique ID for a provider.
 func serviceIDForProvider(providerName string) string {
 	return fmt.Sprintf("%s-service-%s", idPrefix, strings.ToLower(providerName))
@@ -16,66 +16,214 @@ package broker
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/mongodb/atlas-osb/pkg/broker/dynamicplans"
+	"github.com/mongodb/atlas-osb/pkg/broker/encryption"
+	"github.com/mongodb/atlas-osb/pkg/broker/statestorage"
 	"github.com/pivotal-cf/brokerapi/domain"
 	"github.com/pkg/errors"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
 )
 
-type StateStorage interface {
-	Put(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error
-	Get(ctx context.Context, key string) (*domain.GetInstanceDetailsSpec, error)
-	Update(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error
-	Delete(ctx context.Context, key string) error
+// The state storage backends which can be selected with Config.StateStorage.
+const (
+	stateStorageRealm   = "realm"
+	stateStorageMongoDB = "mongodb"
+	stateStorageFile    = "file"
+)
+
+// NewStateBackend sets up the state storage backend selected in cfg. It is
+// used by the broker itself and by the state maintenance commands.
+func NewStateBackend(ctx context.Context, logger *zap.SugaredLogger, cfg Config, userAgent string) (statestorage.Backend, error) {
+	switch cfg.StateStorage {
+	case stateStorageRealm, "":
+		return &statestorage.RealmBackend{
+			UserAgent: userAgent,
+			AtlasURL:  cfg.AtlasURL,
+			RealmURL:  cfg.RealmURL,
+			Logger:    logger,
+		}, nil
+
+	case stateStorageMongoDB:
+		if cfg.StateStorageURI == "" {
+			return nil, errors.New("state storage URI must be set for the mongodb backend")
+		}
+
+		return statestorage.NewMongoBackend(ctx, cfg.StateStorageURI, cfg.StateStorageDB)
+
+	case stateStorageFile:
+		if cfg.StateStorageURI == "" {
+			return nil, errors.New("state storage URI must be set to a file path for the file backend")
+		}
+
+		return statestorage.NewFileBackend(cfg.StateStorageURI)
+
+	default:
+		return nil, fmt.Errorf("unknown state storage backend %q", cfg.StateStorage)
+	}
 }
 
-type mongoStorage struct {
-	client *mongo.Client
+func (b *Broker) getState(ctx context.Context, orgID string) (statestorage.StateStorage, error) {
+	key, err := b.credentials.ByOrg(orgID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get API Key by org")
+	}
+
+	return b.state.Open(ctx, key)
 }
 
-type mongoData struct {
-	ID    string                         `bson:"id"`
-	Value *domain.GetInstanceDetailsSpec `bson:",omitempty"`
+// encodeState serializes the instance state for storage, sealing it if state
+// encryption is enabled.
+func (b *Broker) encodeState(s instanceState) (string, error) {
+	enc, err := encodeRecord(s)
+	if err != nil || b.keyring == nil {
+		return enc, err
+	}
+
+	return b.keyring.Seal(enc)
 }
 
-func NewMongoStorage(client *mongo.Client) StateStorage {
-	return &mongoStorage{client}
+// decodeState reverses encodeState. stale reports whether the stored value
+// should be rewritten, because it is unencrypted, sealed with a master key
+// which is no longer the primary one or uses an older schema version.
+func (b *Broker) decodeState(enc string) (s instanceState, stale bool, err error) {
+	if encryption.IsSealed(enc) {
+		if b.keyring == nil {
+			err = errors.New("instance state is encrypted, but no master keys are configured")
+
+			return
+		}
+
+		var keyID string
+		keyID, err = encryption.KeyID(enc)
+		if err != nil {
+			return
+		}
+
+		stale = keyID != b.keyring.PrimaryKeyID()
+
+		enc, err = b.keyring.Open(enc)
+		if err != nil {
+			err = errors.Wrap(err, "cannot decrypt instance state")
+
+			return
+		}
+	} else {
+		stale = b.keyring != nil
+	}
+
+	s, version, err := decodeRecord(enc)
+	stale = stale || version < currentSchemaVersion
+
+	return
 }
 
-func (m mongoStorage) Put(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error {
-	_, err := m.client.
-		Database("atlas-broker").
-		Collection("instances").
-		InsertOne(ctx, mongoData{ID: key, Value: value})
+// MoveInstanceToOrg rewrites the stored value of an instance which is moved to
+// the organization orgID, e.g. by "state import --org". The plan then refers
+// to the new organization and uses the broker's API key for it, as an API key
+// of the old organization won't have access.
+func (b *Broker) MoveInstanceToOrg(v *domain.GetInstanceDetailsSpec, orgID string) error {
+	enc, ok := v.Parameters.(string)
+	if !ok {
+		return fmt.Errorf("instance metadata has the wrong type %T", v.Parameters)
+	}
 
-	return errors.Wrap(err, "cannot insert value")
+	s, _, err := b.decodeState(enc)
+	if err != nil {
+		return err
+	}
+
+	if s.Plan.Project == nil {
+		return errors.New("plan has no project")
+	}
+
+	s.Plan.Project.OrgID = orgID
+	s.Plan.APIKey = nil
+
+	v.Parameters, err = b.encodeState(s)
+
+	return err
 }
 
-func (m mongoStorage) Update(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error {
-	_, err := m.client.
-		Database("atlas-broker").
-		Collection("instances").
-		UpdateOne(ctx, mongoData{ID: key}, mongoData{ID: key, Value: value})
+// errUpToDate stops upgradeState from writing a record which another writer
+// has upgraded already.
+var errUpToDate = errors.New("instance state is up to date")
+
+// upgradeState rewrites the stored state of the instance with the current
+// encoding, unless it already uses it.
+func (b *Broker) upgradeState(ctx context.Context, instanceID string) error {
+	orgID, ok := b.state.Lookup(instanceID)
+	if !ok {
+		return fmt.Errorf("organization of instance %q is not known", instanceID)
+	}
+
+	state, err := b.getState(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	err = statestorage.Modify(ctx, state, instanceID, func(v *domain.GetInstanceDetailsSpec) error {
+		enc, _ := v.Parameters.(string)
+
+		s, stale, err := b.decodeState(enc)
+		switch {
+		case err != nil:
+			return err
+		case !stale:
+			return errUpToDate
+		}
 
-	return errors.Wrap(err, "cannot update value")
+		v.Parameters, err = b.encodeState(s)
+
+		return err
+	})
+	if errors.Is(err, errUpToDate) {
+		return nil
+	}
+
+	return err
 }
 
-func (m mongoStorage) Get(ctx context.Context, key string) (s *domain.GetInstanceDetailsSpec, err error) {
-	result := mongoData{}
-	err = m.client.
-		Database("atlas-broker").
-		Collection("instances").
-		FindOne(ctx, mongoData{ID: key}).
-		Decode(&result)
+// replacePlan sets the plan of the instance to p, as long as it is still at
+// the revision base the caller read it at. Otherwise another handler changed
+// the plan in the meantime, and the caller would undo that change.
+func (s *instanceState) replacePlan(base int, p *dynamicplans.Plan) error {
+	if s.PlanRevision != base {
+		return errConcurrentOperation
+	}
 
-	return result.Value, errors.Wrap(err, "cannot find/decode value")
+	s.Plan = *p
+	s.PlanRevision++
+
+	return nil
 }
 
-func (m mongoStorage) Delete(ctx context.Context, key string) error {
-	_, err := m.client.
-		Database("atlas-broker").
-		Collection("instances").
-		DeleteOne(ctx, mongoData{ID: key})
+// modifyInstance decodes the stored state of the instance, lets fn change it
+// and writes it back atomically.
+func (b *Broker) modifyInstance(ctx context.Context, orgID string, instanceID string, fn func(spec *domain.GetInstanceDetailsSpec, s *instanceState) error) error {
+	state, err := b.getState(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	return statestorage.Modify(ctx, state, instanceID, func(v *domain.GetInstanceDetailsSpec) error {
+		enc, ok := v.Parameters.(string)
+		if !ok {
+			return fmt.Errorf("instance metadata has the wrong type %T", v.Parameters)
+		}
+
+		s, _, err := b.decodeState(enc)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(v, &s); err != nil {
+			return err
+		}
+
+		v.Parameters, err = b.encodeState(s)
 
-	return errors.Wrap(err, "cannot delete value")
+		return err
+	})
 }
@@ -0,0 +1,164 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statestorage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+)
+
+// ArchiveVersion is the version of the archive format written by Export.
+const ArchiveVersion = 1
+
+// Archive is a backup of the state of all instances, independent of the
+// backend it was taken from. Instance parameters are copied as they are
+// stored, so encrypted state needs the same master keys after import.
+type Archive struct {
+	Version   int                `json:"version"`
+	CreatedAt time.Time          `json:"createdAt"`
+	Instances []ArchivedInstance `json:"instances"`
+}
+
+type ArchivedInstance struct {
+	OrgID      string                         `json:"orgId"`
+	InstanceID string                         `json:"instanceId"`
+	Value      *domain.GetInstanceDetailsSpec `json:"value"`
+}
+
+// ImportReport lists what Import did with every archived instance.
+type ImportReport struct {
+	Imported  []string `json:"imported"`
+	Unchanged []string `json:"unchanged"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// Export reads the state of every instance of the given organizations.
+func Export(ctx context.Context, backend Backend, keys map[string]credentials.Credential) (*Archive, error) {
+	a := &Archive{
+		Version:   ArchiveVersion,
+		CreatedAt: time.Now().UTC(),
+		Instances: []ArchivedInstance{},
+	}
+
+	for orgID, key := range keys {
+		s, err := backend.Open(ctx, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot open state storage of org %s", orgID)
+		}
+
+		ids, err := s.List(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot list instances of org %s", orgID)
+		}
+
+		for _, id := range ids {
+			v, _, err := s.Get(ctx, id)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot get instance %s of org %s", id, orgID)
+			}
+
+			a.Instances = append(a.Instances, ArchivedInstance{OrgID: orgID, InstanceID: id, Value: v})
+		}
+	}
+
+	sort.Slice(a.Instances, func(i, j int) bool {
+		if a.Instances[i].OrgID != a.Instances[j].OrgID {
+			return a.Instances[i].OrgID < a.Instances[j].OrgID
+		}
+
+		return a.Instances[i].InstanceID < a.Instances[j].InstanceID
+	})
+
+	return a, nil
+}
+
+// MoveFunc rewrites the value of an instance which is moved to the
+// organization orgID.
+type MoveFunc func(value *domain.GetInstanceDetailsSpec, orgID string) error
+
+// Import writes the archived instances to the backend. orgMap optionally
+// moves instances to a different organization, their values are rewritten by
+// move. Instances which already exist are never overwritten: they are
+// reported as unchanged if the stored value is identical and as conflicts
+// otherwise.
+func Import(ctx context.Context, backend Backend, keys map[string]credentials.Credential, a *Archive, orgMap map[string]string, move MoveFunc) (*ImportReport, error) {
+	if a.Version != ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+
+	report := &ImportReport{}
+	storages := map[string]StateStorage{}
+
+	for _, i := range a.Instances {
+		orgID, value := i.OrgID, i.Value
+		if mapped, ok := orgMap[orgID]; ok && mapped != orgID {
+			if move == nil {
+				return report, fmt.Errorf("cannot move instance %s to organization %s", i.InstanceID, mapped)
+			}
+
+			orgID = mapped
+			moved := *value
+			if err := move(&moved, orgID); err != nil {
+				return report, errors.Wrapf(err, "cannot move instance %s to organization %s", i.InstanceID, orgID)
+			}
+
+			value = &moved
+		}
+
+		s, ok := storages[orgID]
+		if !ok {
+			key, ok := keys[orgID]
+			if !ok {
+				return report, fmt.Errorf("no API key for organization %s", orgID)
+			}
+
+			var err error
+			s, err = backend.Open(ctx, key)
+			if err != nil {
+				return report, errors.Wrapf(err, "cannot open state storage of org %s", orgID)
+			}
+
+			storages[orgID] = s
+		}
+
+		existing, _, err := s.Get(ctx, i.InstanceID)
+		switch {
+		case err == nil && reflect.DeepEqual(existing, value):
+			report.Unchanged = append(report.Unchanged, i.InstanceID)
+
+		case err == nil:
+			report.Conflicts = append(report.Conflicts, i.InstanceID)
+
+		case errors.Is(err, ErrInstanceNotFound):
+			if err := s.Put(ctx, i.InstanceID, value); err != nil {
+				return report, errors.Wrapf(err, "cannot import instance %s", i.InstanceID)
+			}
+
+			report.Imported = append(report.Imported, i.InstanceID)
+
+		default:
+			return report, errors.Wrapf(err, "cannot check instance %s", i.InstanceID)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,80 @@
+package statestorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string]credentials.Credential{
+		"org-1": {"orgID": "org-1"},
+		"org-2": {"orgID": "org-2"},
+	}
+
+	source, err := NewFileBackend(filepath.Join(t.TempDir(), "source.json"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s, _ := source.Open(ctx, keys["org-1"])
+	_ = s.Put(ctx, "instance-1", &domain.GetInstanceDetailsSpec{PlanID: "plan-1"})
+	_ = s.Put(ctx, "instance-2", &domain.GetInstanceDetailsSpec{PlanID: "plan-2"})
+
+	archive, err := Export(ctx, source, keys)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(archive.Instances) != 2 {
+		t.Fatalf("unexpected archive: %+v", archive)
+	}
+
+	target, err := NewFileBackend(filepath.Join(t.TempDir(), "target.json"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	d, _ := target.Open(ctx, keys["org-2"])
+	_ = d.Put(ctx, "instance-2", &domain.GetInstanceDetailsSpec{PlanID: "other"})
+
+	move := func(v *domain.GetInstanceDetailsSpec, orgID string) error {
+		v.ServiceID = "moved to " + orgID
+
+		return nil
+	}
+
+	if _, err := Import(ctx, target, keys, archive, map[string]string{"org-1": "org-2"}, nil); err == nil {
+		t.Fatal("expected moving instances without a move function to fail")
+	}
+
+	report, err := Import(ctx, target, keys, archive, map[string]string{"org-1": "org-2"}, move)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(report.Imported) != 1 || len(report.Conflicts) != 1 || report.Conflicts[0] != "instance-2" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if v, _, _ := d.Get(ctx, "instance-2"); v.PlanID != "other" {
+		t.Fatalf("conflicting instance was overwritten: %+v", v)
+	}
+
+	if v, _, _ := d.Get(ctx, "instance-1"); v.ServiceID != "moved to org-2" {
+		t.Fatalf("moved instance was not rewritten: %+v", v)
+	}
+
+	report, err = Import(ctx, target, keys, archive, map[string]string{"org-1": "org-2"}, move)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(report.Imported) != 0 || len(report.Unchanged) != 1 {
+		t.Fatalf("unexpected report on second import: %+v", report)
+	}
+}
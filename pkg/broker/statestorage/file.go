@@ -0,0 +1,232 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statestorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+)
+
+// FileBackend stores the state of all organizations in a single JSON file on
+// the local disk. It is meant for development and air-gapped installations:
+// writes replace the file atomically and are serialized with a lock file, so
+// several broker processes on the same host can share it.
+type FileBackend struct {
+	path string
+	mu   sync.Mutex
+}
+
+var _ Backend = &FileBackend{}
+
+// fileState maps organization IDs to the instances stored for them.
+type fileState map[string]map[string]*record
+
+func NewFileBackend(path string) (*FileBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "cannot create state directory")
+	}
+
+	b := &FileBackend{path: path}
+
+	// make sure the file is readable before the broker starts serving
+	err := b.transaction(func(fileState) (bool, error) {
+		return false, nil
+	})
+
+	return b, err
+}
+
+func (b *FileBackend) Open(ctx context.Context, key credentials.Credential) (StateStorage, error) {
+	return &FileStateStorage{
+		OrgID:   key["orgID"],
+		backend: b,
+	}, nil
+}
+
+// transaction runs fn on the current contents of the state file while holding
+// both the in-process and the file lock. The file is rewritten if fn reports
+// a change and returns no error.
+func (b *FileBackend) transaction(fn func(state fileState) (changed bool, err error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lock, err := os.OpenFile(b.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot open lock file")
+	}
+	defer lock.Close()
+
+	if err := lockFile(lock); err != nil {
+		return errors.Wrap(err, "cannot lock state file")
+	}
+	defer unlockFile(lock) // nolint:errcheck
+
+	state, err := b.read()
+	if err != nil {
+		return err
+	}
+
+	changed, err := fn(state)
+	if err != nil || !changed {
+		return err
+	}
+
+	return b.write(state)
+}
+
+func (b *FileBackend) read() (fileState, error) {
+	state := fileState{}
+
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read state file")
+	}
+
+	if len(data) == 0 {
+		return state, nil
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal state file")
+	}
+
+	return state, nil
+}
+
+func (b *FileBackend) write(state fileState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal state")
+	}
+
+	// write to a temporary file in the same directory and rename it over the
+	// original, so readers never see a partially written file
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "cannot create temporary state file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+
+		return errors.Wrap(err, "cannot write temporary state file")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return errors.Wrap(err, "cannot sync temporary state file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot close temporary state file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), b.path), "cannot replace state file")
+}
+
+// FileStateStorage is the view of a FileBackend limited to one organization.
+type FileStateStorage struct {
+	OrgID   string
+	backend *FileBackend
+}
+
+var _ StateStorage = &FileStateStorage{}
+
+func (fs *FileStateStorage) Put(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error {
+	return fs.backend.transaction(func(state fileState) (bool, error) {
+		if _, ok := state[fs.OrgID][key]; ok {
+			return false, fmt.Errorf("value with name %q already exists", key)
+		}
+
+		if state[fs.OrgID] == nil {
+			state[fs.OrgID] = map[string]*record{}
+		}
+
+		state[fs.OrgID][key] = &record{Revision: 1, GetInstanceDetailsSpec: value}
+
+		return true, nil
+	})
+}
+
+func (fs *FileStateStorage) Get(ctx context.Context, key string) (spec *domain.GetInstanceDetailsSpec, revision Revision, err error) {
+	err = fs.backend.transaction(func(state fileState) (bool, error) {
+		r, ok := state[fs.OrgID][key]
+		if !ok {
+			return false, ErrInstanceNotFound
+		}
+
+		spec, revision = r.GetInstanceDetailsSpec, r.Revision
+
+		return false, nil
+	})
+
+	return
+}
+
+func (fs *FileStateStorage) Update(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec, revision Revision) error {
+	return fs.backend.transaction(func(state fileState) (bool, error) {
+		r, ok := state[fs.OrgID][key]
+		if !ok {
+			return false, ErrInstanceNotFound
+		}
+
+		if r.Revision != revision {
+			return false, errors.Wrapf(ErrConflict, "expected revision %d, found %d", revision, r.Revision)
+		}
+
+		state[fs.OrgID][key] = &record{Revision: revision + 1, GetInstanceDetailsSpec: value}
+
+		return true, nil
+	})
+}
+
+func (fs *FileStateStorage) Delete(ctx context.Context, key string) error {
+	return fs.backend.transaction(func(state fileState) (bool, error) {
+		if _, ok := state[fs.OrgID][key]; !ok {
+			return false, ErrInstanceNotFound
+		}
+
+		delete(state[fs.OrgID], key)
+
+		return true, nil
+	})
+}
+
+func (fs *FileStateStorage) List(ctx context.Context) (keys []string, err error) {
+	err = fs.backend.transaction(func(state fileState) (bool, error) {
+		for k := range state[fs.OrgID] {
+			keys = append(keys, k)
+		}
+
+		return false, nil
+	})
+
+	return
+}
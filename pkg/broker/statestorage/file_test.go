@@ -0,0 +1,136 @@
+package statestorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+)
+
+func TestFileStateStorage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state", "broker.json")
+
+	backend, err := NewFileBackend(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state, err := backend.Open(ctx, credentials.Credential{"orgID": "org-1"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	t.Run("Put and Get", func(t *testing.T) {
+		err := state.Put(ctx, "instance-1", &domain.GetInstanceDetailsSpec{PlanID: "plan-1", Parameters: "params"})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		spec, _, err := state.Get(ctx, "instance-1")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if spec.PlanID != "plan-1" || spec.Parameters != "params" {
+			t.Fatalf("unexpected value: %+v", spec)
+		}
+	})
+
+	t.Run("Put refuses to overwrite", func(t *testing.T) {
+		err := state.Put(ctx, "instance-1", &domain.GetInstanceDetailsSpec{PlanID: "plan-2"})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("Values survive reopening", func(t *testing.T) {
+		reopened, err := NewFileBackend(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		state, _ := reopened.Open(ctx, credentials.Credential{"orgID": "org-1"})
+		spec, _, err := state.Get(ctx, "instance-1")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if spec.PlanID != "plan-1" {
+			t.Fatalf("unexpected value: %+v", spec)
+		}
+	})
+
+	t.Run("Organizations are isolated", func(t *testing.T) {
+		other, _ := backend.Open(ctx, credentials.Credential{"orgID": "org-2"})
+		if _, _, err := other.Get(ctx, "instance-1"); !errors.Is(err, ErrInstanceNotFound) {
+			t.Fatalf("expected ErrInstanceNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Update checks the revision", func(t *testing.T) {
+		_, rev, err := state.Get(ctx, "instance-1")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		err = state.Update(ctx, "instance-1", &domain.GetInstanceDetailsSpec{PlanID: "plan-2"}, rev)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		err = state.Update(ctx, "instance-1", &domain.GetInstanceDetailsSpec{PlanID: "plan-3"}, rev)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected ErrConflict, got %v", err)
+		}
+
+		spec, newRev, _ := state.Get(ctx, "instance-1")
+		if spec.PlanID != "plan-2" || newRev != rev+1 {
+			t.Fatalf("unexpected value: %+v (revision %d)", spec, newRev)
+		}
+	})
+
+	t.Run("Modify retries on conflict", func(t *testing.T) {
+		attempts := 0
+		err := Modify(ctx, state, "instance-1", func(spec *domain.GetInstanceDetailsSpec) error {
+			attempts++
+			if attempts == 1 {
+				// simulate a concurrent writer
+				_, rev, _ := state.Get(ctx, "instance-1")
+				if err := state.Update(ctx, "instance-1", &domain.GetInstanceDetailsSpec{PlanID: "plan-4"}, rev); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+
+			spec.DashboardURL = "dashboard"
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		spec, _, _ := state.Get(ctx, "instance-1")
+		if attempts != 2 || spec.PlanID != "plan-4" || spec.DashboardURL != "dashboard" {
+			t.Fatalf("unexpected value after %d attempts: %+v", attempts, spec)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+
+		if err := state.Delete(ctx, "instance-1"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, _, err := state.Get(ctx, "instance-1"); !errors.Is(err, ErrInstanceNotFound) {
+			t.Fatalf("expected ErrInstanceNotFound, got %v", err)
+		}
+
+		if err := state.Update(ctx, "instance-1", &domain.GetInstanceDetailsSpec{}, 1); !errors.Is(err, ErrInstanceNotFound) {
+			t.Fatalf("expected ErrInstanceNotFound, got %v", err)
+		}
+	})
+}
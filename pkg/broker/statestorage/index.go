@@ -0,0 +1,207 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statestorage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Index wraps a Backend and remembers which organization every instance
+// belongs to, so finding an instance doesn't require searching the storage of
+// every organization. Storages are opened once per organization and reused.
+//
+// The index is kept current by the storages it hands out and rebuilt
+// periodically by Run, which picks up changes made by other broker replicas.
+type Index struct {
+	backend Backend
+	logger  *zap.SugaredLogger
+
+	mu       sync.RWMutex
+	storages map[string]StateStorage
+	orgs     map[string]string
+}
+
+var _ Backend = &Index{}
+
+func NewIndex(backend Backend, logger *zap.SugaredLogger) *Index {
+	return &Index{
+		backend:  backend,
+		logger:   logger,
+		storages: map[string]StateStorage{},
+		orgs:     map[string]string{},
+	}
+}
+
+// Open returns the cached storage of the key's organization, opening it on
+// first use.
+func (i *Index) Open(ctx context.Context, key credentials.Credential) (StateStorage, error) {
+	orgID := key["orgID"]
+
+	i.mu.RLock()
+	s, ok := i.storages[orgID]
+	i.mu.RUnlock()
+
+	if ok {
+		return s, nil
+	}
+
+	opened, err := i.backend.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// another goroutine might have opened it in the meantime
+	if s, ok := i.storages[orgID]; ok {
+		return s, nil
+	}
+
+	s = &indexedStorage{StateStorage: opened, orgID: orgID, index: i}
+	i.storages[orgID] = s
+
+	return s, nil
+}
+
+// Lookup returns the organization the instance belongs to, if known.
+func (i *Index) Lookup(instanceID string) (orgID string, ok bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	orgID, ok = i.orgs[instanceID]
+
+	return
+}
+
+func (i *Index) set(instanceID string, orgID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.orgs[instanceID] = orgID
+}
+
+func (i *Index) remove(instanceID string, orgID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.orgs[instanceID] == orgID {
+		delete(i.orgs, instanceID)
+	}
+}
+
+// Refresh rebuilds the index from the storages of all given organizations.
+// Entries of organizations which fail to list are kept as they are.
+func (i *Index) Refresh(ctx context.Context, keys map[string]credentials.Credential) error {
+	orgs := map[string]string{}
+	failed := map[string]bool{}
+
+	var lastErr error
+	for orgID, key := range keys {
+		s, err := i.Open(ctx, key)
+		if err == nil {
+			var ids []string
+			ids, err = s.List(ctx)
+			for _, id := range ids {
+				orgs[id] = orgID
+			}
+		}
+
+		if err != nil {
+			i.logger.Errorw("Cannot index state storage", "orgID", orgID, "error", err)
+			failed[orgID] = true
+			lastErr = errors.Wrapf(err, "cannot index state storage of org %s", orgID)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for id, orgID := range i.orgs {
+		if failed[orgID] {
+			orgs[id] = orgID
+		}
+	}
+
+	i.orgs = orgs
+
+	return lastErr
+}
+
+// Run refreshes the index immediately and then every interval until ctx is
+// cancelled.
+func (i *Index) Run(ctx context.Context, keys map[string]credentials.Credential, interval time.Duration) {
+	_ = i.Refresh(ctx, keys)
+
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			_ = i.Refresh(ctx, keys)
+		}
+	}
+}
+
+// indexedStorage keeps the index up to date with the changes made through it.
+type indexedStorage struct {
+	StateStorage
+	orgID string
+	index *Index
+}
+
+func (s *indexedStorage) Put(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error {
+	err := s.StateStorage.Put(ctx, key, value)
+	if err == nil {
+		s.index.set(key, s.orgID)
+	}
+
+	return err
+}
+
+func (s *indexedStorage) Get(ctx context.Context, key string) (*domain.GetInstanceDetailsSpec, Revision, error) {
+	v, rev, err := s.StateStorage.Get(ctx, key)
+	switch {
+	case err == nil:
+		s.index.set(key, s.orgID)
+	case errors.Is(err, ErrInstanceNotFound):
+		s.index.remove(key, s.orgID)
+	}
+
+	return v, rev, err
+}
+
+func (s *indexedStorage) Delete(ctx context.Context, key string) error {
+	err := s.StateStorage.Delete(ctx, key)
+	if err == nil || errors.Is(err, ErrInstanceNotFound) {
+		s.index.remove(key, s.orgID)
+	}
+
+	return err
+}
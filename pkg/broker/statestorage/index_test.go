@@ -0,0 +1,65 @@
+package statestorage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"go.uber.org/zap"
+)
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "broker.json")
+	keys := map[string]credentials.Credential{
+		"org-1": {"orgID": "org-1"},
+		"org-2": {"orgID": "org-2"},
+	}
+
+	backend, err := NewFileBackend(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	index := NewIndex(backend, zap.NewNop().Sugar())
+
+	t.Run("Put and Delete keep the index current", func(t *testing.T) {
+		state, _ := index.Open(ctx, keys["org-2"])
+		if err := state.Put(ctx, "instance-1", &domain.GetInstanceDetailsSpec{}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if orgID, ok := index.Lookup("instance-1"); !ok || orgID != "org-2" {
+			t.Fatalf("unexpected lookup result: %q %v", orgID, ok)
+		}
+
+		if err := state.Delete(ctx, "instance-1"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, ok := index.Lookup("instance-1"); ok {
+			t.Fatal("deleted instance is still indexed")
+		}
+	})
+
+	t.Run("Refresh picks up changes made elsewhere", func(t *testing.T) {
+		other, _ := backend.Open(ctx, keys["org-1"])
+		if err := other.Put(ctx, "instance-2", &domain.GetInstanceDetailsSpec{}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, ok := index.Lookup("instance-2"); ok {
+			t.Fatal("instance indexed before refresh")
+		}
+
+		if err := index.Refresh(ctx, keys); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if orgID, ok := index.Lookup("instance-2"); !ok || orgID != "org-1" {
+			t.Fatalf("unexpected lookup result: %q %v", orgID, ok)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statestorage
+
+import (
+	"context"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const mongoCollectionName = "instances"
+
+// MongoBackend stores the state of all organizations in a single MongoDB
+// collection, one document per instance.
+type MongoBackend struct {
+	collection *mongo.Collection
+}
+
+var _ Backend = &MongoBackend{}
+
+// NewMongoBackend connects to the MongoDB deployment at uri and makes sure the
+// state collection in the given database is indexed.
+func NewMongoBackend(ctx context.Context, uri string, database string) (*MongoBackend, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to MongoDB")
+	}
+
+	collection := client.Database(database).Collection(mongoCollectionName)
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "orgId", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create state index")
+	}
+
+	return &MongoBackend{collection: collection}, nil
+}
+
+func (b *MongoBackend) Open(ctx context.Context, key credentials.Credential) (StateStorage, error) {
+	return &MongoStateStorage{
+		OrgID:      key["orgID"],
+		collection: b.collection,
+	}, nil
+}
+
+// MongoStateStorage is the view of a MongoBackend limited to one organization.
+type MongoStateStorage struct {
+	OrgID      string
+	collection *mongo.Collection
+}
+
+var _ StateStorage = &MongoStateStorage{}
+
+type mongoRecord struct {
+	ID       string                         `bson:"id"`
+	OrgID    string                         `bson:"orgId"`
+	Revision Revision                       `bson:"revision"`
+	Value    *domain.GetInstanceDetailsSpec `bson:"value"`
+}
+
+func (ms *MongoStateStorage) filter(key string) bson.M {
+	return bson.M{"orgId": ms.OrgID, "id": key}
+}
+
+func (ms *MongoStateStorage) Put(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error {
+	_, err := ms.collection.InsertOne(ctx, mongoRecord{ID: key, OrgID: ms.OrgID, Revision: 1, Value: value})
+
+	return errors.Wrap(err, "cannot insert value")
+}
+
+func (ms *MongoStateStorage) Get(ctx context.Context, key string) (*domain.GetInstanceDetailsSpec, Revision, error) {
+	result := mongoRecord{}
+
+	err := ms.collection.FindOne(ctx, ms.filter(key)).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, 0, ErrInstanceNotFound
+	}
+
+	return result.Value, result.Revision, errors.Wrap(err, "cannot find/decode value")
+}
+
+func (ms *MongoStateStorage) Update(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec, revision Revision) error {
+	filter := ms.filter(key)
+	if revision == 0 {
+		// documents written before revisions were introduced lack the field
+		filter["revision"] = bson.M{"$in": bson.A{0, nil}}
+	} else {
+		filter["revision"] = revision
+	}
+
+	r, err := ms.collection.ReplaceOne(ctx, filter, mongoRecord{ID: key, OrgID: ms.OrgID, Revision: revision + 1, Value: value})
+	if err != nil {
+		return errors.Wrap(err, "cannot update value")
+	}
+
+	if r.MatchedCount > 0 {
+		return nil
+	}
+
+	n, err := ms.collection.CountDocuments(ctx, ms.filter(key))
+	if err != nil {
+		return errors.Wrap(err, "cannot count values")
+	}
+
+	if n == 0 {
+		return ErrInstanceNotFound
+	}
+
+	return errors.Wrapf(ErrConflict, "expected revision %d", revision)
+}
+
+func (ms *MongoStateStorage) Delete(ctx context.Context, key string) error {
+	r, err := ms.collection.DeleteOne(ctx, ms.filter(key))
+	if err != nil {
+		return errors.Wrap(err, "cannot delete value")
+	}
+
+	if r.DeletedCount == 0 {
+		return ErrInstanceNotFound
+	}
+
+	return nil
+}
+
+func (ms *MongoStateStorage) List(ctx context.Context) ([]string, error) {
+	cur, err := ms.collection.Find(ctx, bson.M{"orgId": ms.OrgID}, options.Find().SetProjection(bson.M{"id": 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list values")
+	}
+
+	records := []mongoRecord{}
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, errors.Wrap(err, "cannot decode values")
+	}
+
+	keys := make([]string, 0, len(records))
+	for _, r := range records {
+		keys = append(keys, r.ID)
+	}
+
+	return keys, nil
+}
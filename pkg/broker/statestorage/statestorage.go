@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/Sectorbob/mlab-ns2/gae/ns/digest"
 	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
@@ -36,12 +37,37 @@ const (
 
 var ErrInstanceNotFound = errors.New("unable to find instance in state storage")
 
+// RealmBackend stores the state of each organization as Realm values of
+// an app in the organization's maintenance project.
+type RealmBackend struct {
+	UserAgent string
+	AtlasURL  string
+	RealmURL  string
+	Logger    *zap.SugaredLogger
+}
+
+var _ Backend = &RealmBackend{}
+
+func (b *RealmBackend) Open(ctx context.Context, key credentials.Credential) (StateStorage, error) {
+	return Get(ctx, key, b.UserAgent, b.AtlasURL, b.RealmURL, b.Logger)
+}
+
+var _ StateStorage = &RealmStateStorage{}
+
 type RealmStateStorage struct {
 	OrgID        string `json:"orgId,omitempty"`
 	RealmClient  *mongodbrealm.Client
 	RealmApp     *mongodbrealm.RealmApp
 	RealmProject *mongodbatlas.Project
 	Logger       *zap.SugaredLogger
+
+	// ids caches Realm value IDs by value name, so lookups of known values
+	// don't need to list every value of the app.
+	ids   map[string]string
+	idsMu sync.RWMutex
+
+	locks   map[string]*sync.Mutex
+	locksMu sync.Mutex
 }
 
 func client(baseURL string, userAgent string, k credentials.Credential) (*mongodbatlas.Client, error) {
@@ -91,6 +117,7 @@ func Get(ctx context.Context, key credentials.Credential, userAgent string, atla
 		RealmApp:     realmApp,
 		RealmProject: mainPrj,
 		Logger:       logger,
+		ids:          map[string]string{},
 	}
 
 	return rss, nil
@@ -159,7 +186,45 @@ func getOrCreateRealmAppForOrg(ctx context.Context, groupID string, realmClient
 }
 
 func (ss *RealmStateStorage) idByName(ctx context.Context, name string) (id string, err error) {
+	ss.idsMu.RLock()
+	id, ok := ss.ids[name]
+	ss.idsMu.RUnlock()
+
+	if ok {
+		return id, nil
+	}
+
 	// Need to find the one value whose "name" = key
+	if _, err = ss.List(ctx); err != nil {
+		return
+	}
+
+	ss.idsMu.RLock()
+	id, ok = ss.ids[name]
+	ss.idsMu.RUnlock()
+
+	if !ok {
+		return "", errors.Wrapf(ErrInstanceNotFound, "value with name %q not found", name)
+	}
+
+	return id, nil
+}
+
+func (ss *RealmStateStorage) setID(name string, id string) {
+	ss.idsMu.Lock()
+	defer ss.idsMu.Unlock()
+
+	if id == "" {
+		delete(ss.ids, name)
+
+		return
+	}
+
+	ss.ids[name] = id
+}
+
+// List returns the names of all values of the app and refreshes the ID cache.
+func (ss *RealmStateStorage) List(ctx context.Context) ([]string, error) {
 	values, _, err := ss.RealmClient.RealmValues.List(ctx, ss.RealmProject.ID, ss.RealmApp.ID, nil)
 	if err != nil {
 		// return proper InstanceNotFound, if error is realm
@@ -167,30 +232,44 @@ func (ss *RealmStateStorage) idByName(ctx context.Context, name string) (id stri
 			err = ErrInstanceNotFound
 		}
 
-		return
+		return nil, err
 	}
 
+	ids := make(map[string]string, len(values))
+	names := make([]string, 0, len(values))
 	for _, v := range values {
-		if v.Name == name {
-			id = v.ID
+		ids[v.Name] = v.ID
+		names = append(names, v.Name)
+	}
 
-			return
-		}
+	ss.idsMu.Lock()
+	ss.ids = ids
+	ss.idsMu.Unlock()
+
+	return names, nil
+}
+
+func (ss *RealmStateStorage) Get(ctx context.Context, name string) (*domain.GetInstanceDetailsSpec, Revision, error) {
+	_, r, err := ss.getRecord(ctx, name)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return "", fmt.Errorf("value with name %q not found", name)
+	return r.GetInstanceDetailsSpec, r.Revision, nil
 }
 
-func (ss *RealmStateStorage) FindOne(ctx context.Context, name string) (spec *domain.GetInstanceDetailsSpec, err error) {
-	id, err := ss.idByName(ctx, name)
+func (ss *RealmStateStorage) getRecord(ctx context.Context, name string) (id string, r *record, err error) {
+	id, err = ss.idByName(ctx, name)
 	if err != nil {
 		return
 	}
 
-	val, err := ss.Get(ctx, id)
+	val, err := ss.getValue(ctx, id)
 	if err != nil {
 		// return proper InstanceNotFound, if error is realm
 		if strings.Contains(err.Error(), "value not found") {
+			// the value was removed behind our back (e.g. by another replica)
+			ss.setID(name, "")
 			err = ErrInstanceNotFound
 		}
 
@@ -198,30 +277,33 @@ func (ss *RealmStateStorage) FindOne(ctx context.Context, name string) (spec *do
 	}
 
 	if val.Value == nil {
-		return nil, errors.New("val.Value was nil from realm, should never happen")
+		return "", nil, errors.New("val.Value was nil from realm, should never happen")
 	}
 
-	spec = &domain.GetInstanceDetailsSpec{}
-	err = json.Unmarshal(val.Value, &spec)
+	r = &record{}
+	err = json.Unmarshal(val.Value, r)
 
 	return
 }
 
-func (ss *RealmStateStorage) DeleteOne(ctx context.Context, name string) error {
+func (ss *RealmStateStorage) Delete(ctx context.Context, name string) error {
 	id, err := ss.idByName(ctx, name)
 	if err != nil {
 		return err
 	}
 
 	_, err = ss.RealmClient.RealmValues.Delete(ctx, ss.RealmProject.ID, ss.RealmApp.ID, id)
+	if err == nil || strings.Contains(err.Error(), "value not found") {
+		ss.setID(name, "")
+	}
 
 	return err
 }
 
-func (ss *RealmStateStorage) Put(ctx context.Context, name string, value *domain.GetInstanceDetailsSpec) (*mongodbrealm.RealmValue, error) {
-	vv, err := json.Marshal(value)
+func (ss *RealmStateStorage) Put(ctx context.Context, name string, value *domain.GetInstanceDetailsSpec) error {
+	vv, err := json.Marshal(record{Revision: 1, GetInstanceDetailsSpec: value})
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot marshal value")
+		return errors.Wrap(err, "cannot marshal value")
 	}
 
 	val := &mongodbrealm.RealmValue{
@@ -230,12 +312,68 @@ func (ss *RealmStateStorage) Put(ctx context.Context, name string, value *domain
 	}
 
 	v, _, err := ss.RealmClient.RealmValues.Create(ctx, ss.RealmProject.ID, ss.RealmApp.ID, val)
+	if err != nil {
+		return err
+	}
 
-	return v, err
+	ss.setID(name, v.ID)
+	ss.Logger.Infow("Inserted new state value", "v", v)
+
+	return nil
+}
+
+// Update replaces the value in place. Realm has no conditional writes, so the
+// revision is checked right before the write while holding a per-value lock:
+// this fully serializes writers within one broker process, while writers in
+// different processes can only race within the window between the two calls.
+func (ss *RealmStateStorage) Update(ctx context.Context, name string, value *domain.GetInstanceDetailsSpec, revision Revision) error {
+	unlock := ss.lockValue(name)
+	defer unlock()
+
+	id, current, err := ss.getRecord(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if current.Revision != revision {
+		return errors.Wrapf(ErrConflict, "expected revision %d, found %d", revision, current.Revision)
+	}
+
+	vv, err := json.Marshal(record{Revision: revision + 1, GetInstanceDetailsSpec: value})
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal value")
+	}
+
+	_, _, err = ss.RealmClient.RealmValues.Update(ctx, ss.RealmProject.ID, ss.RealmApp.ID, id, &mongodbrealm.RealmValue{
+		ID:    id,
+		Name:  name,
+		Value: vv,
+	})
+
+	return errors.Wrap(err, "cannot update value")
+}
+
+// lockValue serializes updates of a single value and returns the unlock func.
+func (ss *RealmStateStorage) lockValue(name string) func() {
+	ss.locksMu.Lock()
+	if ss.locks == nil {
+		ss.locks = map[string]*sync.Mutex{}
+	}
+
+	l, ok := ss.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		ss.locks[name] = l
+	}
+	ss.locksMu.Unlock()
+
+	l.Lock()
+
+	return l.Unlock
 }
 
-func (ss *RealmStateStorage) Get(ctx context.Context, key string) (*mongodbrealm.RealmValue, error) {
-	v, _, err := ss.RealmClient.RealmValues.Get(ctx, ss.RealmProject.ID, ss.RealmApp.ID, key)
+func (ss *RealmStateStorage) getValue(ctx context.Context, id string) (*mongodbrealm.RealmValue, error) {
+	v, _, err := ss.RealmClient.RealmValues.Get(ctx, ss.RealmProject.ID, ss.RealmApp.ID, id)
 
 	return v, err
 }
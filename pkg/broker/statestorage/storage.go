@@ -0,0 +1,85 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statestorage
+
+import (
+	"context"
+
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/pivotal-cf/brokerapi/domain"
+	"github.com/pkg/errors"
+)
+
+// ErrConflict is returned by Update if the stored value has been changed
+// since the revision passed to it was read.
+var ErrConflict = errors.New("state value was modified concurrently")
+
+// Revision is incremented every time a stored value changes. Values written
+// before revisions were introduced have revision 0.
+type Revision int64
+
+// StateStorage keeps the state of service instances belonging to a single
+// Atlas organization. Get, Update and Delete return ErrInstanceNotFound
+// (possibly wrapped) if there is no value stored under the key. List returns
+// the keys of all stored values.
+//
+// Update is a compare-and-swap: it only replaces the value if it is still at
+// the given revision and returns ErrConflict otherwise, leaving the stored
+// value untouched.
+type StateStorage interface {
+	Put(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec) error
+	Get(ctx context.Context, key string) (*domain.GetInstanceDetailsSpec, Revision, error)
+	Update(ctx context.Context, key string, value *domain.GetInstanceDetailsSpec, revision Revision) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]string, error)
+}
+
+// Backend opens the StateStorage of the organization the API key belongs to.
+type Backend interface {
+	Open(ctx context.Context, key credentials.Credential) (StateStorage, error)
+}
+
+// maxModifyAttempts limits how often Modify retries after a conflict.
+const maxModifyAttempts = 5
+
+// Modify reads the value stored under key, lets fn change it and writes it
+// back. If another writer got in between, the whole cycle is repeated with the
+// fresh value.
+func Modify(ctx context.Context, s StateStorage, key string, fn func(value *domain.GetInstanceDetailsSpec) error) error {
+	for i := 0; i < maxModifyAttempts; i++ {
+		value, revision, err := s.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(value); err != nil {
+			return err
+		}
+
+		err = s.Update(ctx, key, value, revision)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+
+	return errors.Wrapf(ErrConflict, "giving up after %d attempts", maxModifyAttempts)
+}
+
+// record is how the Realm and file backends serialize a value. The spec is
+// embedded so that values written before revisions existed can still be read.
+type record struct {
+	Revision Revision `json:"revision,omitempty"`
+	*domain.GetInstanceDetailsSpec
+}
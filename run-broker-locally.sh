@@ -6,6 +6,8 @@ export BROKER_HOST=0.0.0.0
 export BROKER_PORT=4000
 export BROKER_APIKEYS=$(cat ./samples/apikeys-config.json)
 export ATLAS_BROKER_TEMPLATEDIR=$(pwd)/samples/plans
+export BROKER_STATE_STORAGE=${BROKER_STATE_STORAGE:-file}
+export BROKER_STATE_STORAGE_URI=${BROKER_STATE_STORAGE_URI:-$(pwd)/.broker-state/state.json}
 tree "${ATLAS_BROKER_TEMPLATEDIR}"
 env | grep BROKER
 
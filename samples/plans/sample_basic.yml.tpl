@@ -55,6 +55,13 @@ ipAccessLists:
 - ipAddress: "128.0.0.0/1"
   comment: "everything"
 
+# Maximum duration of asynchronous operations, after which they are reported as failed
+# optional; defaults to BROKER_MAX_OPERATION_DURATION
+# maxDuration:
+#   provision: 2h
+#   update: 2h
+#   deprovision: 1h
+
 # privateEndpoints:
 # - provider: "AZURE"
 #   subscriptionID: AZURE_SUB_ID_HERE
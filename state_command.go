@@ -0,0 +1,182 @@
+// Copyright 2020 MongoDB Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mongodb/atlas-osb/pkg/broker"
+	"github.com/mongodb/atlas-osb/pkg/broker/credentials"
+	"github.com/mongodb/atlas-osb/pkg/broker/encryption"
+	"github.com/mongodb/atlas-osb/pkg/broker/statestorage"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type StateCmd struct {
+	Export *StateExportCmd `arg:"subcommand:export" help:"write the state of all instances to an archive"`
+	Import *StateImportCmd `arg:"subcommand:import" help:"restore instances from an archive"`
+}
+
+type StateExportCmd struct {
+	Output     string `arg:"-o" default:"-" help:"archive file, - for stdout"`
+	ArchiveKey string `arg:"env:BROKER_STATE_ARCHIVE_KEY" help:"id:key master key to encrypt the archive with"`
+}
+
+type StateImportCmd struct {
+	Input      string   `arg:"positional,required" help:"archive file, - for stdin"`
+	ArchiveKey string   `arg:"env:BROKER_STATE_ARCHIVE_KEY" help:"id:key master key the archive was encrypted with"`
+	OrgMap     []string `arg:"--org,separate" help:"move instances to another organization, as old=new"`
+}
+
+func runStateCommand(cmd *StateCmd) error {
+	logger, err := createLogger()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	creds := deduceCredentials(logger, args.AtlasURL)
+	backend, err := broker.NewStateBackend(ctx, logger, broker.Config(args.BrokerConfig), userAgent())
+	if err != nil {
+		return errors.Wrap(err, "cannot set up state storage")
+	}
+
+	switch {
+	case cmd.Export != nil:
+		return exportState(ctx, logger, backend, creds.Keys(), cmd.Export)
+	case cmd.Import != nil:
+		b := broker.NewWithoutWorkers(logger, creds, broker.Config(args.BrokerConfig), userAgent())
+
+		return importState(ctx, logger, backend, creds.Keys(), cmd.Import, b.MoveInstanceToOrg)
+	default:
+		return errors.New("either export or import must be specified")
+	}
+}
+
+func exportState(ctx context.Context, logger *zap.SugaredLogger, backend statestorage.Backend, keys map[string]credentials.Credential, cmd *StateExportCmd) error {
+	archive, err := statestorage.Export(ctx, backend, keys)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal archive")
+	}
+
+	if cmd.ArchiveKey != "" {
+		keyring, err := encryption.ParseKeyring(cmd.ArchiveKey)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse archive key")
+		}
+
+		sealed, err := keyring.Seal(string(data))
+		if err != nil {
+			return errors.Wrap(err, "cannot encrypt archive")
+		}
+
+		data = []byte(sealed)
+	}
+
+	var out io.Writer = os.Stdout
+	if cmd.Output != "-" {
+		f, err := os.OpenFile(cmd.Output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Wrap(err, "cannot create archive file")
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	if _, err := out.Write(data); err != nil {
+		return errors.Wrap(err, "cannot write archive")
+	}
+
+	logger.Infow("Exported state", "instances", len(archive.Instances), "encrypted", cmd.ArchiveKey != "")
+
+	return nil
+}
+
+func importState(ctx context.Context, logger *zap.SugaredLogger, backend statestorage.Backend, keys map[string]credentials.Credential, cmd *StateImportCmd, move statestorage.MoveFunc) error {
+	var (
+		data []byte
+		err  error
+	)
+
+	if cmd.Input == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(cmd.Input)
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "cannot read archive")
+	}
+
+	if encryption.IsSealed(string(data)) {
+		if cmd.ArchiveKey == "" {
+			return errors.New("archive is encrypted, but no archive key was given")
+		}
+
+		keyring, err := encryption.ParseKeyring(cmd.ArchiveKey)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse archive key")
+		}
+
+		opened, err := keyring.Open(string(data))
+		if err != nil {
+			return errors.Wrap(err, "cannot decrypt archive")
+		}
+
+		data = []byte(opened)
+	}
+
+	archive := &statestorage.Archive{}
+	if err := json.Unmarshal(data, archive); err != nil {
+		return errors.Wrap(err, "cannot unmarshal archive")
+	}
+
+	orgMap := map[string]string{}
+	for _, m := range cmd.OrgMap {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid organization mapping %q, expected old=new", m)
+		}
+
+		orgMap[parts[0]] = parts[1]
+	}
+
+	report, err := statestorage.Import(ctx, backend, keys, archive, orgMap, move)
+	if report != nil {
+		logger.Infow("Imported state", "imported", report.Imported, "unchanged", report.Unchanged, "conflicts", report.Conflicts)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(report.Conflicts) > 0 {
+		return errors.Errorf("%d instances already exist with different state and were not imported", len(report.Conflicts))
+	}
+
+	return nil
+}